@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Admin API
+// =============================================================================
+
+// Admin serves a JSON API to inspect the zones, the local records, the
+// upstream servers, the pools and the cache, and to reload the
+// configuration or flush the cache.
+type Admin struct {
+	token string // bearer token, optional on a Unix socket
+	fw    *Forwarder
+	local *LocalServ
+}
+
+// runAdmin serves the admin API on "unix:/path/to/socket" or on a TCP
+// address, which requires a token.
+func runAdmin(addr, token string, fw *Forwarder, local *LocalServ) {
+	a := &Admin{token: token, fw: fw, local: local}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", a.zones)
+	mux.HandleFunc("GET /local", a.records)
+	mux.HandleFunc("GET /upstreams", a.upstreams)
+	mux.HandleFunc("GET /pool", a.pool)
+	mux.HandleFunc("GET /cache", a.cache)
+	mux.HandleFunc("POST /cache/flush", a.flush)
+	mux.HandleFunc("POST /reload", a.reload)
+
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path) // stale socket from a previous run
+		if ln, err = net.Listen("unix", path); err == nil {
+			if err := os.Chmod(path, 0o600); err != nil {
+				log.Warningf("Error setting admin socket mode: %s", err)
+			}
+		}
+	} else {
+		if token == "" {
+			log.Fatalf("Admin API on %s needs -adminTokenFile\n", addr)
+		}
+		if !loopbackAddr(addr) {
+			log.Fatalf("Admin API on %s: not a loopback address, use 127.0.0.1, [::1] or a Unix socket\n", addr)
+		}
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Fatalf("Failed to start admin API: %s\n", err.Error())
+	}
+	log.Infof("Admin API listening on %s", addr)
+	if err := http.Serve(ln, a.authenticate(mux)); err != nil {
+		log.Fatalf("Failed to start admin API: %s\n", err.Error())
+	}
+}
+
+// loopbackAddr reports whether a TCP address only listens on the host
+// itself. An empty host listens on every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+// authenticate checks the bearer token of the requests.
+func (a *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+				return
+			}
+		}
+		log.Debugf("admin: %s %s", r.Method, r.URL)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readToken reads the token of the admin API from a file.
+func readToken(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("EMPTY ADMIN TOKEN")
+	}
+	return token, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// =============================================================================
+// Endpoints
+// =============================================================================
+
+type zoneInfo struct {
+	Name      string   `json:"name"`
+	Domains   []string `json:"domains,omitempty"`
+	Networks  []string `json:"networks,omitempty"`
+	Servers   []string `json:"servers"`
+	Recursive bool     `json:"recursive,omitempty"`
+	NTA       bool     `json:"nta,omitempty"`
+	ECS       string   `json:"ecs"`
+}
+
+func newZoneInfo(zone *Forward) zoneInfo {
+	info := zoneInfo{
+		Name:      zone.Name,
+		Domains:   zone.Domains,
+		Servers:   []string{},
+		Recursive: zone.Recursive,
+		NTA:       zone.NTA,
+		ECS:       zone.ECS.mode,
+	}
+	for _, ipNet := range zone.Networks {
+		info.Networks = append(info.Networks, ipNet.String())
+	}
+	for _, serv := range zone.Servers {
+		info.Servers = append(info.Servers, serv.String())
+	}
+	return info
+}
+
+// zones lists the zones in file order, as they are searched, and the
+// default zone.
+func (a *Admin) zones(w http.ResponseWriter, r *http.Request) {
+	fw := a.fw
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
+	zones := make([]zoneInfo, 0, len(fw.zones))
+	for i := range fw.zones {
+		zones = append(zones, newZoneInfo(&fw.zones[i]))
+	}
+	writeJSON(w, map[string]any{"zones": zones, "default": newZoneInfo(fw.defaultZone)})
+}
+
+type localRecord struct {
+	Host string `json:"host"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+// records lists the records of hosts.txt, sorted by host.
+func (a *Admin) records(w http.ResponseWriter, r *http.Request) {
+	a.local.mu.RLock()
+	records := make([]localRecord, 0, len(a.local.recordsByHost))
+	for host, rec := range a.local.recordsByHost {
+		lr := localRecord{Host: host, Text: rec.Text}
+		if rec.IPv4 != nil {
+			lr.IPv4 = rec.IPv4.String()
+		}
+		if rec.IPv6 != nil {
+			lr.IPv6 = rec.IPv6.String()
+		}
+		records = append(records, lr)
+	}
+	a.local.mu.RUnlock()
+	slices.SortFunc(records, func(a, b localRecord) int { return strings.Compare(a.Host, b.Host) })
+	writeJSON(w, records)
+}
+
+type upstreamInfo struct {
+	Server       string     `json:"server"`
+	Zones        []string   `json:"zones"`
+	Status       string     `json:"status"` // up, down, or unknown until queried
+	Exchanges    uint64     `json:"exchanges"`
+	Errors       uint64     `json:"errors"`
+	AvgLatencyMs float64    `json:"avgLatencyMs"`
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure  *time.Time `json:"lastFailure,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// upstreams reports the health of the configured servers: they are up when
+// their last exchange succeeded.
+func (a *Admin) upstreams(w http.ResponseWriter, r *http.Request) {
+	fw := a.fw
+	upstreams := []*upstreamInfo{}
+	byServer := map[string]*upstreamInfo{}
+	fw.zonesMu.RLock()
+	for _, zone := range append(slices.Clone(fw.zones), *fw.defaultZone) {
+		for _, serv := range zone.Servers {
+			u := byServer[serv.String()]
+			if u == nil {
+				u = &upstreamInfo{Server: serv.String(), Status: "unknown"}
+				byServer[serv.String()] = u
+				upstreams = append(upstreams, u)
+			}
+			if !slices.Contains(u.Zones, zone.Name) {
+				u.Zones = append(u.Zones, zone.Name)
+			}
+		}
+	}
+	fw.zonesMu.RUnlock()
+
+	metrics.mu.Lock()
+	for _, u := range upstreams {
+		m := metrics.upstreams[u.Server]
+		if m == nil {
+			continue
+		}
+		u.Exchanges, u.Errors, u.LastError = m.count, m.errors, m.lastError
+		if m.count > 0 {
+			u.AvgLatencyMs = m.sum / float64(m.count) * 1000
+		}
+		lastSuccess, lastFailure := m.lastSuccess, m.lastFailure
+		if !lastSuccess.IsZero() {
+			u.LastSuccess = &lastSuccess
+			u.Status = "up"
+		}
+		if !lastFailure.IsZero() {
+			u.LastFailure = &lastFailure
+			if lastFailure.After(lastSuccess) {
+				u.Status = "down"
+			}
+		}
+	}
+	metrics.mu.Unlock()
+	writeJSON(w, upstreams)
+}
+
+type poolInfo struct {
+	Server      string `json:"server"`
+	Connections int    `json:"connections"`
+	Idle        int    `json:"idle"`
+	Waiting     int    `json:"waiting"`
+	Saturated   uint64 `json:"saturated"`
+}
+
+// pool reports the TCP/TLS connections of each server.
+func (a *Admin) pool(w http.ResponseWriter, r *http.Request) {
+	pools := []poolInfo{}
+	for addr, s := range a.fw.connPool.stats() {
+		pools = append(pools, poolInfo{addr, s.total, s.idle, s.waiting, s.saturated})
+	}
+	slices.SortFunc(pools, func(a, b poolInfo) int { return strings.Compare(a.Server, b.Server) })
+	writeJSON(w, pools)
+}
+
+// cache reports the cache size, per zone, and its hits and misses.
+func (a *Admin) cache(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries, expired := 0, 0
+	zones := map[string]int{}
+	a.fw.cacheMu.RLock()
+	for _, entry := range a.fw.cache {
+		entries++
+		if entry.Expiry.Before(now) {
+			expired++
+			continue
+		}
+		zones[entry.Zone]++
+	}
+	a.fw.cacheMu.RUnlock()
+	writeJSON(w, map[string]any{
+		"entries": entries,
+		"expired": expired,
+		"zones":   zones,
+		"hits":    metrics.cacheHits.Load(),
+		"misses":  metrics.cacheMisses.Load(),
+	})
+}
+
+// flush flushes the whole cache, or the entries of a name, domain or zone
+// given as parameter.
+func (a *Admin) flush(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	match := matchAll
+	switch {
+	case query.Has("name"):
+		match = matchName(query.Get("name"))
+	case query.Has("domain"):
+		match = matchDomain(query.Get("domain"))
+	case query.Has("zone"):
+		match = matchZone(query.Get("zone"))
+	}
+	writeJSON(w, map[string]int{"flushed": a.fw.flushCache(match)})
+}
+
+// reload reads forward.yaml and hosts.txt again. Both are read before
+// either is used: on error, the current configuration is kept whole.
+func (a *Admin) reload(w http.ResponseWriter, r *http.Request) {
+	log.Info("Reloading configuration")
+	next, err := a.fw.loadZones()
+	if err != nil {
+		var problems configProblems
+		if errors.As(err, &problems) {
+			// strict mode: every problem of forward.yaml
+			lines := make([]string, len(problems))
+			for i, problem := range problems {
+				lines[i] = problem.Error()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "problems": lines})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	records, err := a.local.loadRecords()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.fw.reload(next)
+	a.local.reload(records)
+	a.fw.zonesMu.RLock()
+	zones := len(a.fw.zones)
+	a.fw.zonesMu.RUnlock()
+	a.local.mu.RLock()
+	hosts := len(a.local.recordsByHost)
+	a.local.mu.RUnlock()
+	writeJSON(w, map[string]int{"zones": zones, "hosts": hosts})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"127.0.0.1:8053", true},
+		{"127.0.0.2:8053", true},
+		{"[::1]:8053", true},
+		{"localhost:8053", true},
+		{":8053", false}, // every interface
+		{"0.0.0.0:8053", false},
+		{"[::]:8053", false},
+		{"192.0.2.1:8053", false},
+		{"admin.example.com:8053", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddr(tt.addr); got != tt.loopback {
+			t.Errorf("%s: loopback %t, want %t", tt.addr, got, tt.loopback)
+		}
+	}
+}
+
+// A reload uses forward.yaml and hosts.txt only when both can be read.
+func TestAdminReload(t *testing.T) {
+	log.SetLevel(log.WarnLevel)
+	dir := t.TempDir()
+	forwardFile, hostsFile := filepath.Join(dir, "forward.yaml"), filepath.Join(dir, "hosts.txt")
+	write := func(filename, content string) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(forwardFile, "- servers: [udp://192.0.2.9]\n")
+	write(hostsFile, "www,192.0.2.1\n")
+	a := &Admin{fw: newForwarder(forwardFile, configMode{}), local: newLocalServer(hostsFile)}
+	zones := len(a.fw.zones)
+	a.fw.cache["www.example.com. 1 1"] = CacheEntry{Expiry: time.Now().Add(time.Hour)}
+
+	reload := func() (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		a.reload(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		var body map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+	unchanged := func(step string) {
+		t.Helper()
+		if len(a.fw.zones) != zones || len(a.fw.cache) != 1 || len(a.local.recordsByHost) != 1 {
+			t.Errorf("%s: %d zones, %d cache entries, %d hosts: configuration changed",
+				step, len(a.fw.zones), len(a.fw.cache), len(a.local.recordsByHost))
+		}
+	}
+
+	// a new forward.yaml, but no hosts.txt
+	write(forwardFile, "- name: lan\n  domains: [example.com]\n  servers: [udp://192.0.2.1]\n- servers: [udp://192.0.2.9]\n")
+	os.Remove(hostsFile)
+	if code, body := reload(); code != http.StatusInternalServerError {
+		t.Errorf("without hosts.txt: status %d %v", code, body)
+	}
+	unchanged("without hosts.txt")
+
+	// a new hosts.txt, but a broken forward.yaml
+	write(hostsFile, "www,192.0.2.1\nmail,192.0.2.2\n")
+	write(forwardFile, "- servers: [udp://192.0.2.9\n")
+	if code, body := reload(); code != http.StatusInternalServerError {
+		t.Errorf("with a broken forward.yaml: status %d %v", code, body)
+	}
+	unchanged("with a broken forward.yaml")
+
+	write(forwardFile, "- name: lan\n  domains: [example.com]\n  servers: [udp://192.0.2.1]\n- servers: [udp://192.0.2.9]\n")
+	code, body := reload()
+	if code != http.StatusOK || body["zones"] != float64(zones+1) || body["hosts"] != float64(2) {
+		t.Errorf("reload: status %d %v, want %d zones and 2 hosts", code, body, zones+1)
+	}
+	if len(a.fw.cache) != 0 {
+		t.Errorf("%d cache entries after the reload", len(a.fw.cache))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// builtinRootAnchors are the IANA root zone KSKs (KSK-2017 and KSK-2024).
+var builtinRootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	anchorValid   = "valid"
+	anchorPending = "pending" // new key seen, waiting for the hold-down
+	anchorRevoked = "revoked"
+)
+
+// trustAnchor is a root key we trust, or are about to trust. The built-in
+// anchors are DS records, the ones learned from the root zone are DNSKEYs.
+type trustAnchor struct {
+	Record    string    `json:"record"`
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"firstSeen"`
+	rr        dns.RR
+}
+
+// TrustAnchors holds the root trust anchors, kept up to date with the
+// automated rollover of RFC 5011: a new KSK signed by a trusted one becomes
+// trusted after a hold-down time, a KSK revoked by itself is no longer
+// trusted. The state is saved to a file when one is given.
+type TrustAnchors struct {
+	filename string
+	mu       sync.Mutex
+	anchors  []*trustAnchor
+}
+
+func newTrustAnchors(filename string) (*TrustAnchors, error) {
+	ta := &TrustAnchors{filename: filename}
+
+	var data []byte
+	var err error
+	if filename != "" {
+		data, err = os.ReadFile(filename)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &ta.anchors); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, record := range builtinRootAnchors {
+			ta.anchors = append(ta.anchors, &trustAnchor{Record: record, State: anchorValid})
+		}
+	}
+
+	for _, a := range ta.anchors {
+		a.rr, err = dns.NewRR(a.Record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Loaded %d trust anchors", len(ta.anchors))
+	return ta, nil
+}
+
+// matches reports whether the anchor designates the key. The REVOKE flag is
+// ignored, so that a revoked key still matches its anchor.
+func (a *trustAnchor) matches(k *dns.DNSKEY) bool {
+	key := *k
+	key.Flags &^= dns.REVOKE
+	switch rr := a.rr.(type) {
+	case *dns.DS:
+		ds := key.ToDS(rr.DigestType)
+		return ds != nil && ds.KeyTag == rr.KeyTag && strings.EqualFold(ds.Digest, rr.Digest)
+	case *dns.DNSKEY:
+		return rr.Algorithm == key.Algorithm && rr.PublicKey == key.PublicKey
+	}
+	return false
+}
+
+func (ta *TrustAnchors) find(k *dns.DNSKEY) *trustAnchor {
+	for _, a := range ta.anchors {
+		if a.matches(k) {
+			return a
+		}
+	}
+	return nil
+}
+
+// trusted returns the keys of a root DNSKEY set matching a valid anchor.
+func (ta *TrustAnchors) trusted(keys []*dns.DNSKEY) []*dns.DNSKEY {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	var trusted []*dns.DNSKEY
+	for _, k := range keys {
+		if k.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		if a := ta.find(k); a != nil && a.State == anchorValid {
+			trusted = append(trusted, k)
+		}
+	}
+	return trusted
+}
+
+// update applies RFC 5011 to a root DNSKEY set that has been validated by
+// a trusted key.
+func (ta *TrustAnchors) update(keys []*dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	for _, k := range keys {
+		if k.Flags&dns.SEP == 0 {
+			continue
+		}
+		a := ta.find(k)
+
+		if k.Flags&dns.REVOKE != 0 {
+			// a revoked key must sign the set itself
+			if a != nil && a.State != anchorRevoked && selfSigned(k, rrset, sigs) {
+				log.Warningf("Trust anchor %d revoked", k.KeyTag())
+				a.State = anchorRevoked
+				changed = true
+			}
+			continue
+		}
+
+		switch {
+		case a == nil:
+			log.Infof("New root key %d, trusted after hold-down", k.KeyTag())
+			ta.anchors = append(ta.anchors, &trustAnchor{
+				Record:    k.String(),
+				State:     anchorPending,
+				FirstSeen: now,
+				rr:        k,
+			})
+			changed = true
+		case a.State == anchorPending && now.Sub(a.FirstSeen) >= trustAnchorHoldDown:
+			log.Infof("Root key %d is now a trust anchor", k.KeyTag())
+			a.State = anchorValid
+			changed = true
+		}
+	}
+
+	// a pending key removed before the end of the hold-down is forgotten
+	kept := ta.anchors[:0]
+	for _, a := range ta.anchors {
+		if a.State == anchorPending && !slices.ContainsFunc(keys, a.matches) {
+			log.Infof("Pending root key %d removed", a.rr.(*dns.DNSKEY).KeyTag())
+			changed = true
+			continue
+		}
+		kept = append(kept, a)
+	}
+	ta.anchors = kept
+
+	if changed && ta.filename != "" {
+		if err := ta.save(); err != nil {
+			log.Warningf("Error saving trust anchors: %s", err)
+		}
+	}
+}
+
+func selfSigned(k *dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG) bool {
+	for _, sig := range sigs {
+		if sig.KeyTag == k.KeyTag() && sig.Verify(k, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the anchors to the file, atomically.
+func (ta *TrustAnchors) save() error {
+	data, err := json.MarshalIndent(ta.anchors, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ta.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ta.filename)
+}
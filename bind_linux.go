@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// bindControl returns a net.Dialer Control function binding the socket to
+// the network interface iface (SO_BINDTODEVICE), whatever the routing table
+// says.
+func bindControl(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
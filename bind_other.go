@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindControl is only available on Linux (SO_BINDTODEVICE).
+func bindControl(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("interface binding is only supported on Linux")
+}
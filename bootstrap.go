@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bootstrap resolves the host names of upstream servers (e.g.
+// tls://dns.quad9.net) through fixed bootstrap IPs, never through the system
+// resolver which may well be OwNS itself. Addresses are cached for their
+// TTL; if a refresh fails, the stale addresses keep being used.
+type Bootstrap struct {
+	servers []string // host:port
+	mu      sync.Mutex
+	cache   map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	addrs  []net.IP
+	expiry time.Time
+}
+
+// bootstrap is shared by every upstream server given by name.
+var bootstrap = &Bootstrap{cache: map[string]bootstrapEntry{}}
+
+// setServers sets the bootstrap servers from a comma separated list of IPs,
+// with an optional port.
+func (b *Bootstrap) setServers(list string) error {
+	servers, err := splitAddrs(list)
+	if err != nil {
+		return fmt.Errorf("BOOTSTRAP SERVER ERROR: %s", err)
+	}
+	b.servers = servers
+	return nil
+}
+
+// splitAddrs parses a comma separated list of IPs with an optional port
+// (53 by default) into host:port addresses.
+func splitAddrs(list string) ([]string, error) {
+	var addrs []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, errors.New(s)
+		}
+		addrs = append(addrs, s)
+	}
+	return addrs, nil
+}
+
+// lookup returns the addresses of host, from the cache when still fresh.
+func (b *Bootstrap) lookup(host string) ([]net.IP, error) {
+	b.mu.Lock()
+	entry, ok := b.cache[host]
+	b.mu.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.addrs, nil
+	}
+
+	addrs, ttl, err := b.resolve(host)
+	if err != nil {
+		if ok {
+			log.Warningf("Bootstrap: %s, using stale addresses of %s", err, host)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	ttl = max(ttl, bootstrapMinTTL)
+	log.Debugf("Bootstrap: %s => %v (ttl=%d)", host, addrs, ttl)
+	b.mu.Lock()
+	b.cache[host] = bootstrapEntry{addrs: addrs, expiry: time.Now().Add(time.Duration(ttl) * time.Second)}
+	b.mu.Unlock()
+	return addrs, nil
+}
+
+// resolve queries the bootstrap servers for the A and AAAA records of host.
+// It returns the addresses and their smallest TTL.
+func (b *Bootstrap) resolve(host string) ([]net.IP, uint32, error) {
+	if len(b.servers) == 0 {
+		return nil, 0, errors.New("no bootstrap server")
+	}
+	var addrs []net.IP
+	var ttl uint32
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp := b.exchange(new(dns.Msg).SetQuestion(dns.Fqdn(host), qtype))
+		if resp == nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue // CNAME
+			}
+			if len(addrs) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			addrs = append(addrs, ip)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("cannot resolve %s", host)
+	}
+	return addrs, ttl, nil
+}
+
+// exchange sends a query to the bootstrap servers, the first answer wins.
+// Truncated UDP answers are retried over TCP.
+func (b *Bootstrap) exchange(query *dns.Msg) *dns.Msg {
+	for _, server := range b.servers {
+		c := &dns.Client{Timeout: defaultUpstreamTimeout}
+		resp, _, err := c.Exchange(query, server)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.Exchange(query, server)
+		}
+		if err != nil {
+			log.Debugf("Bootstrap: %s: %s", server, err)
+			continue
+		}
+		if resp.Rcode == dns.RcodeSuccess {
+			return resp
+		}
+	}
+	return nil
+}
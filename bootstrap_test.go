@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useBootstrap replaces the bootstrap servers for the test.
+func useBootstrap(t *testing.T, b *Bootstrap) {
+	t.Helper()
+	saved := bootstrap
+	bootstrap = b
+	t.Cleanup(func() { bootstrap = saved })
+}
+
+// bootstrapStub answers the A and AAAA records of the names it knows.
+type bootstrapStub struct {
+	records map[string][]string
+	queries atomic.Int32
+}
+
+func (s *bootstrapStub) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.queries.Add(1)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	records, ok := s.records[q.Name]
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+	}
+	for _, record := range records {
+		rr, _ := dns.NewRR(record)
+		if rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestBootstrapLookup(t *testing.T) {
+	stub := &bootstrapStub{records: map[string][]string{
+		"dns.test.": {"dns.test. 120 IN A 192.0.2.1", "dns.test. 300 IN AAAA 2001:db8::1"},
+		"v6.test.":  {"v6.test. 10 IN AAAA 2001:db8::2"},
+	}}
+	addr := serveTestUpstream(t, stub, "127.0.0.1:0")
+	b := &Bootstrap{cache: map[string]bootstrapEntry{}}
+	if err := b.setServers(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host  string
+		addrs string
+		ttl   time.Duration
+	}{
+		{"dns.test", "[192.0.2.1 2001:db8::1]", 120 * time.Second},
+		{"v6.test", "[2001:db8::2]", bootstrapMinTTL * time.Second},
+	}
+	for _, tt := range tests {
+		addrs, err := b.lookup(tt.host)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.host, err)
+		}
+		if got := fmt.Sprint(addrs); got != tt.addrs {
+			t.Errorf("%s: got %s, want %s", tt.host, got, tt.addrs)
+		}
+		ttl := time.Until(b.cache[tt.host].expiry)
+		if ttl > tt.ttl || ttl < tt.ttl-time.Minute/2 {
+			t.Errorf("%s: cached for %s, want %s", tt.host, ttl, tt.ttl)
+		}
+	}
+
+	// fresh addresses come from the cache
+	queries := stub.queries.Load()
+	if _, err := b.lookup("dns.test"); err != nil || stub.queries.Load() != queries {
+		t.Errorf("cached addresses resolved again (%v)", err)
+	}
+	if _, err := b.lookup("nx.test"); err == nil {
+		t.Error("unknown name resolved")
+	}
+
+	// stale addresses are used when the bootstrap servers fail
+	b.cache["dns.test"] = bootstrapEntry{addrs: b.cache["dns.test"].addrs, expiry: time.Now().Add(-time.Second)}
+	b.setServers("127.0.0.1:1") // nothing listening
+	addrs, err := b.lookup("dns.test")
+	if err != nil || fmt.Sprint(addrs) != "[192.0.2.1 2001:db8::1]" {
+		t.Errorf("stale addresses: got %v %v", addrs, err)
+	}
+	if _, err := b.lookup("v6.test.other"); err == nil {
+		t.Error("name resolved without bootstrap server")
+	}
+}
+
+func TestDialAddresses(t *testing.T) {
+	useBootstrap(t, &Bootstrap{cache: map[string]bootstrapEntry{
+		"dns.test": {addrs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")},
+			expiry: time.Now().Add(time.Hour)},
+	}})
+	tests := []struct {
+		url   string
+		addrs string
+	}{
+		{"tls://9.9.9.9", "[9.9.9.9:853]"},
+		{"tls://dns.test", "[192.0.2.1:853 192.0.2.2:853 [2001:db8::1]:853]"},
+		{"udp://dns.test?source=192.0.2.100", "[192.0.2.1:53 192.0.2.2:53]"},
+		{"udp://dns.test?source=2001:db8::100", "[[2001:db8::1]:53]"},
+	}
+	for _, tt := range tests {
+		serv, err := parseServer(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := serv.dialAddresses()
+		if err != nil {
+			t.Errorf("%s: %s", tt.url, err)
+			continue
+		}
+		if got := fmt.Sprint(addrs); got != tt.addrs {
+			t.Errorf("%s: got %s, want %s", tt.url, got, tt.addrs)
+		}
+	}
+
+	useBootstrap(t, &Bootstrap{cache: map[string]bootstrapEntry{
+		"v4.test": {addrs: []net.IP{net.ParseIP("192.0.2.1")}, expiry: time.Now().Add(time.Hour)},
+	}})
+	serv, _ := parseServer("udp://v4.test?source=2001:db8::100")
+	if addrs, err := serv.dialAddresses(); err == nil {
+		t.Errorf("IPv4 only server dialed from an IPv6 source: %v", addrs)
+	}
+}
+
+// A server whose first address doesn't answer is reached on the next one.
+func TestDialFailover(t *testing.T) {
+	serv, _ := fakeTCPServer(t, echoServer)
+	useBootstrap(t, &Bootstrap{cache: map[string]bootstrapEntry{
+		"dns.test": {addrs: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+			expiry: time.Now().Add(time.Hour)},
+	}})
+	serv.Addr = "dns.test"
+	// nothing listens on 127.0.0.2 at the port of the server
+	conn, err := serv.dial(serv.client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("dialed %s", conn.RemoteAddr())
+	}
+
+	// over UDP too
+	addr := serveTestUpstream(t, &bootstrapStub{records: map[string][]string{
+		"dns.test.": {"dns.test. 60 IN A 192.0.2.1"},
+	}}, "127.0.0.1:0")
+	c := &dns.Client{Timeout: time.Second}
+	resp, err := exchangeAny(c, new(dns.Msg).SetQuestion("dns.test.", dns.TypeA), []string{"127.0.0.1:1", addr})
+	if err != nil || len(resp.Answer) != 1 {
+		t.Errorf("UDP failover: %v %v", resp, err)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Commands
+// =============================================================================
+
+// commands run instead of the server, returning the exit code.
+var commands = map[string]func(args []string) int{
+	"check":   runCheck,
+	"query":   runQuery,
+	"explain": runExplain,
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage:
+  owns [flags]                       run the server
+  owns check [flags]                 check forward.yaml and hosts.txt
+  owns query [flags] name [type]     resolve a name, as the server does
+  owns explain [flags] name          show the rule and servers answering a name or IP
+
+Flags of the server:
+`)
+	flag.PrintDefaults()
+}
+
+// newCommandFlags returns the flags of a command, with -confDir and
+// -longestMatch, which must be those of the server.
+func newCommandFlags(name, args string, confDir *string, longestMatch *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(confDir, "confDir", defaultConfigDir, "Configuration directory")
+	fs.BoolVar(longestMatch, "longestMatch", false, "Route to the zone of the most specific network or domain, as the server with -longestMatch")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: owns %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runCheck reports every problem of forward.yaml and hosts.txt, the exit
+// code telling whether there is any. With -strict, forward.yaml is checked
+// as the server does with -strict.
+func runCheck(args []string) int {
+	var confDir string
+	var strict, longestMatch bool
+	fs := newCommandFlags("check", "", &confDir, &longestMatch)
+	fs.BoolVar(&strict, "strict", false, "Check forward.yaml strictly, reporting the positions of the problems")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	problems := 0
+	report := func(err error) {
+		fmt.Println(err)
+		problems++
+	}
+
+	filename := confDir + "/forward.yaml"
+	if strict {
+		// the problems found by extract, and more, with their positions
+		if data, err := os.ReadFile(filename); err != nil {
+			report(fmt.Errorf("%s: Error reading file: %w", filename, err))
+		} else {
+			problems, warnings := validateConfig(filename, data, longestMatch)
+			for _, warning := range warnings {
+				fmt.Printf("warning: %s\n", warning)
+			}
+			for _, problem := range problems {
+				report(problem)
+			}
+		}
+	}
+	if fwConfigs, err := readForwardConfig(filename, configMode{}); err != nil {
+		if !strict {
+			report(fmt.Errorf("%s: %w", filename, err))
+		}
+	} else {
+		fw, problems := buildZones(fwConfigs, false)
+		for _, problem := range problems {
+			if !strict {
+				report(fmt.Errorf("%s: %w", filename, problem))
+			}
+		}
+		if !fw.defaultZone.usable() {
+			report(fmt.Errorf("%s: NO DEFAULT SERVERS", filename))
+		}
+		fmt.Printf("%s: %d zones, %d default servers\n", filename, len(fw.zones), len(fw.defaultServers))
+	}
+
+	filename = confDir + "/hosts.txt"
+	if records, recordProblems, err := readRecords(filename); err != nil {
+		report(err)
+	} else {
+		for _, problem := range recordProblems {
+			report(problem)
+		}
+		fmt.Printf("%s: %d hosts\n", filename, len(records))
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problems\n", problems)
+		return 1
+	}
+	return 0
+}
+
+// runQuery resolves a name in-process, through the cache, hosts.txt and
+// the zones, as the server answers its clients: the flags changing the
+// resolution are those of the server.
+func runQuery(args []string) int {
+	var confDir, logLevel, trustAnchorFile, bootstrapServers, rootHints string
+	var dnssec, longestMatch bool
+	fs := newCommandFlags("query", "name [type]", &confDir, &longestMatch)
+	fs.StringVar(&logLevel, "logLevel", "WARNING", "Log level (e.g., WARNING, INFO, DEBUG)")
+	fs.BoolVar(&dnssec, "dnssec", false, "Validate the upstream answers with DNSSEC")
+	fs.StringVar(&trustAnchorFile, "trustAnchorFile", "", "File keeping the root trust anchors up to date (built-in anchors if empty)")
+	fs.StringVar(&bootstrapServers, "bootstrap", defaultBootstrap, "Comma separated IPs resolving upstream host names")
+	fs.StringVar(&rootHints, "rootHints", defaultRootHints, "Comma separated IPs of the root servers (recursive zones)")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+	qtype := dns.TypeA
+	if fs.NArg() == 2 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(fs.Arg(1))]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown type: %s\n", fs.Arg(1))
+			return 2
+		}
+	}
+	if err := setLogLevel(logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := bootstrap.setServers(bootstrapServers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := recursor.setRootHints(rootHints); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fw := newForwarder(confDir+"/forward.yaml", configMode{longestMatch: longestMatch})
+	if dnssec {
+		anchors, err := newTrustAnchors(trustAnchorFile)
+		if err != nil {
+			log.Fatalf("Error loading trust anchors: %s", err)
+		}
+		fw.validator = newValidator(fw, anchors)
+	}
+	local := newLocalServer(confDir + "/hosts.txt")
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(fs.Arg(0)), qtype)
+	w := &commandWriter{}
+	start := time.Now()
+	zone, source := answer(local, fw, w, r)
+	if w.msg == nil {
+		fmt.Println(";; no answer")
+		return 1
+	}
+	if zone == "" {
+		zone = fw.route(r).Name
+	}
+	fmt.Println(w.msg)
+	fmt.Printf(";; zone: %s, source: %s, time: %s\n", zone, source, time.Since(start).Round(time.Microsecond))
+	return 0
+}
+
+// runExplain shows how a name, or an IP address, would be answered.
+func runExplain(args []string) int {
+	var confDir string
+	var longestMatch bool
+	fs := newCommandFlags("explain", "name", &confDir, &longestMatch)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	log.SetLevel(log.WarnLevel)
+	fw := newForwarder(confDir+"/forward.yaml", configMode{longestMatch: longestMatch})
+	local := newLocalServer(confDir + "/hosts.txt")
+	explain(fw, local, fs.Arg(0))
+	return 0
+}
+
+// explain prints the rule answering a name, as the server chooses it:
+// hosts.txt first, then the zone of the network (reverse queries) or of the
+// domain, else the default zone.
+func explain(fw *Forwarder, local *LocalServ, name string) {
+	fqdn := dns.Fqdn(name)
+	if net.ParseIP(name) != nil {
+		fqdn, _ = dns.ReverseAddr(name)
+	}
+	query := strings.TrimSuffix(fqdn, ".")
+	fmt.Printf("name:    %s\n", fqdn)
+
+	var zone *Forward
+	var rule string
+	if ip := queryToIP(query); ip != nil {
+		if host, _, ok := local.findRecordByIP(ip); ok {
+			fmt.Printf("rule:    local (hosts.txt: %s)\n", host)
+			return
+		}
+		if zone = fw.findZoneByIP(ip); zone != nil {
+			rule = "network " + matchingNetwork(zone, ip)
+		}
+	} else {
+		if _, ok := local.findRecordByFQDN(query); ok {
+			fmt.Println("rule:    local (hosts.txt)")
+			return
+		}
+		if zone = fw.findZoneByFQDN(query); zone != nil {
+			rule = "domain " + matchingDomain(zone, query)
+		}
+	}
+
+	switch {
+	case zone == nil:
+		fmt.Println("rule:    default")
+	case !zone.usable():
+		fmt.Printf("rule:    zone %s (%s), without servers: default\n", zone.Name, rule)
+	default:
+		fmt.Printf("rule:    zone %s (%s)\n", zone.Name, rule)
+	}
+	zone = fw.zoneOrDefault(zone)
+
+	var servers []string
+	for _, serv := range zone.Servers {
+		servers = append(servers, serv.String())
+	}
+	if zone.Recursive {
+		servers = append([]string{"recursion from the root servers"}, servers...)
+	}
+	if len(servers) == 0 {
+		servers = []string{"none"}
+	}
+	fmt.Printf("servers: %s\n", strings.Join(servers, ", "))
+	if zone.ECS.mode != ecsStrip {
+		fmt.Printf("ecs:     %s (/%d, /%d)\n", zone.ECS.mode, zone.ECS.prefix4, zone.ECS.prefix6)
+	}
+	if zone.NTA {
+		fmt.Println("dnssec:  not validated (nta)")
+	}
+}
+
+// matchingNetwork returns the most specific network of the zone holding ip.
+func matchingNetwork(zone *Forward, ip net.IP) string {
+	var best *net.IPNet
+	for _, ipNet := range zone.Networks {
+		if !ipNet.Contains(ip) {
+			continue
+		}
+		if best == nil || maskSize(ipNet) > maskSize(best) {
+			best = ipNet
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.String()
+}
+
+// maskSize returns the prefix length of a network, counted on the IPv4
+// address for IPv4-mapped IPv6 networks (::ffff:10.0.0.0/104 is 10.0.0.0/8).
+func maskSize(ipNet *net.IPNet) int {
+	ones, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv6len && ipNet.IP.To4() != nil {
+		return ones - 8*(net.IPv6len-net.IPv4len)
+	}
+	return ones
+}
+
+// matchingDomain returns the most specific domain of the zone holding fqdn.
+func matchingDomain(zone *Forward, fqdn string) string {
+	best := ""
+	for _, domain := range zone.Domains {
+		if inDomain(fqdn, domain) && len(domain) > len(best) {
+			best = domain
+		}
+	}
+	return best
+}
+
+// commandWriter keeps the response of a query answered by a command.
+type commandWriter struct {
+	msg *dns.Msg
+}
+
+func (w *commandWriter) LocalAddr() net.Addr       { return &net.TCPAddr{IP: net.IPv6loopback} }
+func (w *commandWriter) RemoteAddr() net.Addr      { return &net.TCPAddr{IP: net.IPv6loopback} }
+func (w *commandWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *commandWriter) Write([]byte) (int, error) { return 0, fmt.Errorf("not supported") }
+func (w *commandWriter) Close() error              { return nil }
+func (w *commandWriter) TsigStatus() error         { return nil }
+func (w *commandWriter) TsigTimersOnly(bool)       {}
+func (w *commandWriter) Hijack()                   {}
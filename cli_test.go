@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+// The flags changing the resolution are checked as the server does.
+func TestRunQueryFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, 2},
+		{[]string{"example.com", "A", "extra"}, 2},
+		{[]string{"example.com", "NOTATYPE"}, 2},
+		{[]string{"-logLevel", "LOUD", "example.com"}, 2},
+		{[]string{"-bootstrap", "1.2.3", "example.com"}, 2},
+		{[]string{"-rootHints", "bogus", "example.com"}, 2},
+	}
+	for _, tt := range tests {
+		if code := runQuery(tt.args); code != tt.code {
+			t.Errorf("%v: exit code %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}
@@ -7,6 +7,37 @@ import "time"
 const (
 	// cacheCleanupInterval is how often expired cache entries are pruned.
 	cacheCleanupInterval = 1 * time.Minute
+
+	// cacheSaveInterval is how often the cache is written to -cacheFile.
+	cacheSaveInterval = 5 * time.Minute
+)
+
+// ── Configuration ──
+
+const (
+	// defaultConfigDir holds forward.yaml and hosts.txt.
+	defaultConfigDir = "/etc/owns"
+)
+
+// ── Zones ──
+
+const (
+	// defaultZoneName names the zone of the default servers.
+	defaultZoneName = "default"
+
+	// localZoneName names the hosts.txt entries in the metrics.
+	localZoneName = "local"
+)
+
+// ── Bootstrap ──
+
+const (
+	// defaultBootstrap lists the servers resolving upstream host names.
+	defaultBootstrap = "9.9.9.9,149.112.112.112"
+
+	// bootstrapMinTTL is the minimum time in seconds upstream addresses
+	// are cached.
+	bootstrapMinTTL = 60
 )
 
 // ── Static hosts ──
@@ -19,11 +50,153 @@ const (
 // ── Connection pool ──
 
 const (
-	// defaultMaxPerServer is the maximum number of persistent TCP/TLS
-	// connections kept idle per upstream server.
+	// defaultMaxPerServer is the default maximum number of persistent
+	// TCP/TLS connections opened per upstream server (-poolSize, pool=).
 	defaultMaxPerServer = 4
 
-	// poolWaitTimeout is how long a goroutine waits for an idle connection
-	// when the pool is saturated before falling back to the next server.
-	poolWaitTimeout = 100 * time.Millisecond
+	// maxInflightPerConn is the maximum number of queries pipelined on a
+	// single connection before another one is dialed.
+	maxInflightPerConn = 64
+
+	// defaultPoolWait is how long a goroutine waits for room on a connection
+	// when the pool is saturated before falling back to the next server
+	// (-poolWait, wait=).
+	defaultPoolWait = 100 * time.Millisecond
+
+	// defaultIdleTimeout is how long an unused pooled connection is kept
+	// open. DoT servers commonly close idle connections after 10-30s
+	// (see tests/test_idle.go).
+	defaultIdleTimeout = 10 * time.Second
+
+	// poolReapInterval is how often idle pooled connections are closed.
+	poolReapInterval = 1 * time.Second
+
+	// maxConnTimeouts is the number of queries timing out in a row on a
+	// pooled connection before it is closed as wedged.
+	maxConnTimeouts = 3
+
+	// defaultUpstreamTimeout is how long to wait for an upstream to connect
+	// or answer (-timeout, timeout=).
+	defaultUpstreamTimeout = 2 * time.Second
+)
+
+// ── EDNS ──
+
+const (
+	// ednsUDPSize is the EDNS buffer size advertised upstream, whatever the
+	// clients ask for (DNS flag day 2020).
+	ednsUDPSize = 1232
+
+	// paddingBlockSize is the block length TLS queries are padded to
+	// (RFC 8467).
+	paddingBlockSize = 128
+)
+
+// ── Cookies ──
+
+const (
+	// defaultCookielessLimit is the number of UDP queries per second a
+	// client can send without a valid server cookie before being asked to
+	// retry over TCP or with the cookie (-cookielessLimit).
+	defaultCookielessLimit = 100
+
+	// cookieMaxAge is how long a server cookie we gave stays valid.
+	cookieMaxAge = 1 * time.Hour
+
+	// cookieMaxSkew tolerates server cookies from the near future, e.g.
+	// generated by another instance with a clock ahead.
+	cookieMaxSkew = 5 * time.Minute
+)
+
+// ── Client subnet ──
+
+const (
+	// defaultECSPrefix4 and defaultECSPrefix6 are the prefix lengths of the
+	// client subnets added to the queries (RFC 7871 recommendations).
+	defaultECSPrefix4 = 24
+	defaultECSPrefix6 = 56
+)
+
+// ── DNSSEC ──
+
+const (
+	// dnssecMinTTL and dnssecMaxTTL bound the time in seconds validated
+	// keys and DS records are cached.
+	dnssecMinTTL = 30
+	dnssecMaxTTL = 3600
+
+	// maxDenialRecords is the maximum number of NSEC/NSEC3 RRsets kept to
+	// synthesize negative answers (RFC 8198).
+	maxDenialRecords = 10000
+
+	// maxNSEC3Iterations is the number of NSEC3 hash iterations above which
+	// the proofs of a zone are handled as insecure, not computed (RFC 9276).
+	maxNSEC3Iterations = 100
+
+	// trustAnchorHoldDown is how long a new root key must be seen before
+	// it is trusted (RFC 5011).
+	trustAnchorHoldDown = 30 * 24 * time.Hour
+)
+
+// ── Recursion ──
+
+const (
+	// defaultRootHints lists the root servers recursive zones start from,
+	// IPv4 first (-rootHints).
+	defaultRootHints = "198.41.0.4,170.247.170.2,192.33.4.12,199.7.91.13," +
+		"192.203.230.10,192.5.5.241,192.112.36.4,198.97.190.53,192.36.148.17," +
+		"192.58.128.30,193.0.14.129,199.7.83.42,202.12.27.33," +
+		"2001:503:ba3e::2:30,2801:1b8:10::b,2001:500:2::c,2001:500:2d::d," +
+		"2001:500:a8::e,2001:500:2f::f,2001:500:12::d0d,2001:500:1::53," +
+		"2001:7fe::53,2001:503:c27::2:30,2001:7fd::1,2001:500:9f::42,2001:dc3::35"
+
+	// maxReferrals is the maximum number of referrals followed to resolve
+	// a name.
+	maxReferrals = 32
+
+	// maxRecursionDepth limits the nested resolutions (CNAME targets, name
+	// server names without glue).
+	maxRecursionDepth = 8
+
+	// delegationMinTTL and delegationMaxTTL bound the time in seconds the
+	// name servers of a zone are cached.
+	delegationMinTTL = 60
+	delegationMaxTTL = 86400
+)
+
+// ── Metrics ──
+
+// upstreamLatencyBuckets are the upper bounds in seconds of the upstream
+// latency histogram.
+var upstreamLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// ── Query log ──
+
+const (
+	// queryLogBuffer is the number of records waiting for a slow sink
+	// before new ones are dropped.
+	queryLogBuffer = 4096
+
+	// defaultQueryLogMaxSize is the size in MB of a query log file before
+	// it is rotated.
+	defaultQueryLogMaxSize = 100
+
+	// defaultQueryLogBackups is the number of rotated files kept.
+	defaultQueryLogBackups = 5
+
+	// queryLogCloseTimeout bounds the time spent at exit writing the
+	// queued records.
+	queryLogCloseTimeout = 5 * time.Second
+)
+
+// ── dnstap ──
+
+const (
+	// dnstapBuffer is the number of messages waiting for a slow collector
+	// before new ones are dropped.
+	dnstapBuffer = 4096
+
+	// dnstapRetryInterval is the delay before connecting again to a
+	// collector gone away, and the timeout of the handshake.
+	dnstapRetryInterval = 5 * time.Second
 )
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Cache inspection & flush
+// =============================================================================
+
+// cacheMatcher selects cache entries for listing or flushing.
+type cacheMatcher func(entry CacheEntry) bool
+
+func matchAll(CacheEntry) bool { return true }
+
+// matchName selects the entries for exactly this name.
+func matchName(name string) cacheMatcher {
+	name = dns.CanonicalName(name)
+	return func(entry CacheEntry) bool {
+		return entryName(entry) == name
+	}
+}
+
+// matchDomain selects the entries for this domain and everything below it.
+func matchDomain(domain string) cacheMatcher {
+	domain = dns.CanonicalName(domain)
+	return func(entry CacheEntry) bool {
+		return dns.IsSubDomain(domain, entryName(entry))
+	}
+}
+
+// matchZone selects the entries answered by the named forward zone.
+func matchZone(zone string) cacheMatcher {
+	return func(entry CacheEntry) bool {
+		return entry.Zone == zone
+	}
+}
+
+func entryName(entry CacheEntry) string {
+	if len(entry.Response.Question) == 0 {
+		return ""
+	}
+	return dns.CanonicalName(entry.Response.Question[0].Name)
+}
+
+// listCache returns a description of the live cache entries selected by
+// match, sorted by name. With details, the cached answers are included.
+func (fw *Forwarder) listCache(match cacheMatcher, details bool) []string {
+	now := time.Now()
+	var lines []string
+
+	fw.cacheMu.RLock()
+	for _, entry := range fw.cache {
+		if entry.Expiry.Before(now) || !match(entry) {
+			continue
+		}
+		lines = append(lines, describeEntry(entry, details))
+	}
+	fw.cacheMu.RUnlock()
+
+	sort.Strings(lines)
+	return lines
+}
+
+func describeEntry(entry CacheEntry, details bool) string {
+	var b strings.Builder
+	q := entry.Response.Question[0]
+	ttl := uint32(time.Until(entry.Expiry).Seconds())
+	fmt.Fprintf(&b, "%s %s %s ttl=%d zone=%s", q.Name, dns.ClassToString[q.Qclass],
+		dns.TypeToString[q.Qtype], ttl, entry.Zone)
+	if !details {
+		return b.String()
+	}
+	for _, rr := range entry.Response.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		fmt.Fprintf(&b, "\n    %s", rr.String())
+	}
+	return b.String()
+}
+
+// flushCache removes the cache entries selected by match and returns how
+// many were removed.
+func (fw *Forwarder) flushCache(match cacheMatcher) int {
+	count := 0
+	fw.cacheMu.Lock()
+	for key, entry := range fw.cache {
+		if match(entry) {
+			delete(fw.cache, key)
+			count++
+		}
+	}
+	fw.cacheMu.Unlock()
+	if fw.validator != nil {
+		fw.validator.flushDenials()
+	}
+	log.Infof("Flushed %d cache entries", count)
+	return count
+}
+
+// =============================================================================
+// Control socket
+// =============================================================================
+
+const controlHelp = `commands:
+  cache list                 list cache entries
+  cache show <name>          show cached answers for a name
+  cache flush                flush the whole cache
+  cache flush name <name>    flush a single name
+  cache flush domain <name>  flush a domain and everything below it
+  cache flush zone <zone>    flush the answers of a forward zone`
+
+// runControl serves the control commands on a Unix socket, one command per
+// line. Use it with e.g. `echo cache list | nc -U /run/owns.sock`.
+func runControl(path string, fw *Forwarder) {
+	os.Remove(path) // stale socket from a previous run
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Failed to start control socket: %s\n", err.Error())
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		log.Warningf("Error setting control socket mode: %s", err)
+	}
+	log.Infof("Control socket listening on %s", path)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Warningf("Control socket: %s", err)
+			continue
+		}
+		go handleControl(conn, fw)
+	}
+}
+
+func handleControl(conn net.Conn, fw *Forwarder) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		log.Debugf("control: %s", strings.Join(args, " "))
+		runCommand(conn, fw, args)
+	}
+}
+
+// runCommand executes one control command and writes its result to w.
+func runCommand(w io.Writer, fw *Forwarder, args []string) {
+	if args[0] != "cache" || len(args) < 2 {
+		fmt.Fprintln(w, controlHelp)
+		return
+	}
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		for _, line := range fw.listCache(matchAll, false) {
+			fmt.Fprintln(w, line)
+		}
+	case args[1] == "show" && len(args) == 3:
+		for _, line := range fw.listCache(matchName(args[2]), true) {
+			fmt.Fprintln(w, line)
+		}
+	case args[1] == "flush" && len(args) == 2:
+		fmt.Fprintf(w, "flushed %d entries\n", fw.flushCache(matchAll))
+	case args[1] == "flush" && len(args) == 4:
+		var match cacheMatcher
+		switch args[2] {
+		case "name":
+			match = matchName(args[3])
+		case "domain":
+			match = matchDomain(args[3])
+		case "zone":
+			match = matchZone(args[3])
+		default:
+			fmt.Fprintln(w, controlHelp)
+			return
+		}
+		fmt.Fprintf(w, "flushed %d entries\n", fw.flushCache(match))
+	default:
+		fmt.Fprintln(w, controlHelp)
+	}
+}
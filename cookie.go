@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS cookies (RFC 7873) are carried as hex strings by the dns package: 16
+// characters of client cookie, followed by 16 to 64 characters of server
+// cookie.
+const clientCookieLen = 16
+
+// findCookie returns the cookie option of a message, if any.
+func findCookie(m *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// setCookie replaces the cookie option of a message, adding EDNS if needed.
+func setCookie(m *dns.Msg, cookie string) {
+	if m.IsEdns0() == nil {
+		m.SetEdns0(ednsUDPSize, false)
+	}
+	removeOptions(m, dns.EDNS0COOKIE)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// =============================================================================
+// Upstream cookies
+// =============================================================================
+
+// UpstreamCookies holds our client cookie for each UDP server, and the
+// server cookie it gave us. An answer echoing another client cookie can't
+// answer our query: it is dropped as spoofed.
+type UpstreamCookies struct {
+	mu      sync.Mutex
+	servers map[string]*upstreamCookie // by server key
+}
+
+type upstreamCookie struct {
+	client string
+	server string
+}
+
+var upstreamCookies = &UpstreamCookies{servers: map[string]*upstreamCookie{}}
+
+// add sets the cookie of the server in a query.
+func (uc *UpstreamCookies) add(serv Server, query *dns.Msg) {
+	uc.mu.Lock()
+	c := uc.servers[serv.key()]
+	if c == nil {
+		c = &upstreamCookie{client: hex.EncodeToString(randomBytes(clientCookieLen / 2))}
+		uc.servers[serv.key()] = c
+	}
+	cookie := c.client + c.server
+	uc.mu.Unlock()
+	setCookie(query, cookie)
+}
+
+// check verifies the cookie of an answer and learns the server cookie.
+// Servers not supporting cookies answer without any, but once a server gave
+// us its cookie, an answer without one is dropped (RFC 7873 5.3).
+func (uc *UpstreamCookies) check(serv Server, resp *dns.Msg) error {
+	cookie := findCookie(resp)
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	c := uc.servers[serv.key()]
+	if cookie == nil {
+		if c != nil && c.server != "" {
+			return errors.New("no cookie from a server supporting them, answer dropped")
+		}
+		return nil
+	}
+	if c == nil || len(cookie.Cookie) < clientCookieLen || cookie.Cookie[:clientCookieLen] != c.client {
+		return errors.New("client cookie mismatch, answer dropped")
+	}
+	if n := len(cookie.Cookie) - clientCookieLen; n >= 16 && n <= 64 {
+		c.server = cookie.Cookie[clientCookieLen:]
+	}
+	return nil
+}
+
+// =============================================================================
+// Server cookies
+// =============================================================================
+
+// ServerCookies answers the cookies of our clients. Server cookies follow
+// RFC 9018 (version, timestamp and hash of the client cookie and address),
+// with HMAC-SHA256 as hash and a secret drawn at startup. A client sending
+// back a valid server cookie proves it gets our answers, so its address
+// isn't spoofed. Over UDP, the other clients are asked to retry over TCP, or
+// with the cookie we give them, when they send too many queries or when
+// cookies are required.
+type ServerCookies struct {
+	enabled  bool
+	required bool // every UDP query needs a valid server cookie
+	limit    int  // queries per second of a client without a valid cookie
+	secret   []byte
+
+	mu     sync.Mutex
+	second int64          // current rate limiting window
+	counts map[string]int // queries of each client during this second
+}
+
+var serverCookies = &ServerCookies{
+	enabled: true,
+	limit:   defaultCookielessLimit,
+	secret:  randomBytes(32),
+	counts:  map[string]int{},
+}
+
+// apply checks the cookie of a request. It returns the writer adding our
+// cookie to the response, or false when the request has already been
+// answered (malformed cookie, or retry asked).
+func (sc *ServerCookies) apply(w dns.ResponseWriter, r *dns.Msg) (dns.ResponseWriter, bool) {
+	if !sc.enabled {
+		return w, true
+	}
+	ip := remoteIP(w.RemoteAddr())
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	cookie := findCookie(r)
+
+	if cookie == nil {
+		if udp && sc.restricted(ip) {
+			log.Debugf("cookie: %s without cookie, retry over TCP", ip)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return nil, false
+		}
+		return w, true
+	}
+
+	n := len(cookie.Cookie)
+	if n != clientCookieLen && (n < clientCookieLen+16 || n > clientCookieLen+64) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return nil, false
+	}
+	client := cookie.Cookie[:clientCookieLen]
+	fresh := client + sc.serverCookie(client, ip, uint32(time.Now().Unix()))
+
+	if udp && !sc.valid(cookie.Cookie, ip) && sc.restricted(ip) {
+		log.Debugf("cookie: %s without valid server cookie, BADCOOKIE", ip)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeBadCookie)
+		setCookie(m, fresh)
+		w.WriteMsg(m)
+		return nil, false
+	}
+	return &cookieWriter{ResponseWriter: w, client: r, cookie: fresh}, true
+}
+
+// serverCookie computes the server cookie of a client (RFC 9018).
+func (sc *ServerCookies) serverCookie(client string, ip net.IP, timestamp uint32) string {
+	b := make([]byte, 8, 16)
+	b[0] = 1 // version, then 3 reserved bytes
+	binary.BigEndian.PutUint32(b[4:], timestamp)
+	cc, _ := hex.DecodeString(client)
+	mac := hmac.New(sha256.New, sc.secret)
+	mac.Write(cc)
+	mac.Write(b)
+	mac.Write(ip)
+	return hex.EncodeToString(mac.Sum(b)[:16]) // header and 8 bytes of hash
+}
+
+// valid reports whether a cookie carries a server cookie we gave to this
+// client, recently enough.
+func (sc *ServerCookies) valid(cookie string, ip net.IP) bool {
+	if len(cookie) != clientCookieLen+32 {
+		return false
+	}
+	b, err := hex.DecodeString(cookie[clientCookieLen:])
+	if err != nil || b[0] != 1 {
+		return false
+	}
+	timestamp := binary.BigEndian.Uint32(b[4:8])
+	age := time.Since(time.Unix(int64(timestamp), 0))
+	if age > cookieMaxAge || age < -cookieMaxSkew {
+		return false
+	}
+	expected := sc.serverCookie(cookie[:clientCookieLen], ip, timestamp)
+	return hmac.Equal([]byte(expected), []byte(cookie[clientCookieLen:]))
+}
+
+// restricted counts a UDP query without a valid cookie and reports whether
+// the client must prove its address first.
+func (sc *ServerCookies) restricted(ip net.IP) bool {
+	if sc.required {
+		return true
+	}
+	if sc.limit <= 0 || ip == nil {
+		return false
+	}
+	now := time.Now().Unix()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if now != sc.second {
+		// a new window: the counters never outlive a second
+		sc.second = now
+		clear(sc.counts)
+	}
+	sc.counts[string(ip)]++
+	return sc.counts[string(ip)] > sc.limit
+}
+
+// cookieWriter adds our cookie to the response of a client that sent one.
+type cookieWriter struct {
+	dns.ResponseWriter
+	client *dns.Msg // the request as sent by the client
+	cookie string
+}
+
+func (w *cookieWriter) WriteMsg(m *dns.Msg) error {
+	setCookie(m, w.cookie)
+	truncateToFit(m, w.client)
+	return w.ResponseWriter.WriteMsg(m)
+}
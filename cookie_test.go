@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testClientCookie = "0123456789abcdef"
+
+func newTestServerCookies() *ServerCookies {
+	return &ServerCookies{enabled: true, limit: defaultCookielessLimit, secret: randomBytes(32), counts: map[string]int{}}
+}
+
+func TestServerCookieValid(t *testing.T) {
+	sc := newTestServerCookies()
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+	cookie := func(at time.Time) string {
+		return testClientCookie + sc.serverCookie(testClientCookie, ip, uint32(at.Unix()))
+	}
+	fresh := cookie(now)
+	tampered := []byte(fresh)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		cookie string
+		ip     net.IP
+		valid  bool
+	}{
+		{"fresh", fresh, ip, true},
+		{"half an hour old", cookie(now.Add(-cookieMaxAge / 2)), ip, true},
+		{"too old", cookie(now.Add(-cookieMaxAge - time.Minute)), ip, false},
+		{"within the skew", cookie(now.Add(cookieMaxSkew / 2)), ip, true},
+		{"too far in the future", cookie(now.Add(cookieMaxSkew + time.Minute)), ip, false},
+		{"other address", fresh, net.ParseIP("192.0.2.2"), false},
+		{"other client cookie", "fedcba9876543210" + fresh[clientCookieLen:], ip, false},
+		{"tampered", string(tampered), ip, false},
+		{"client cookie only", testClientCookie, ip, false},
+		{"not hex", testClientCookie + "zz" + fresh[clientCookieLen+2:], ip, false},
+	}
+	for _, tt := range tests {
+		if got := sc.valid(tt.cookie, tt.ip); got != tt.valid {
+			t.Errorf("%s: valid %t, want %t", tt.name, got, tt.valid)
+		}
+	}
+
+	// another secret, e.g. after a restart
+	if newTestServerCookies().valid(fresh, ip) {
+		t.Error("cookie valid with another secret")
+	}
+}
+
+func TestServerCookiesApply(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	sc := newTestServerCookies()
+	valid := testClientCookie + sc.serverCookie(testClientCookie, udp.IP, uint32(time.Now().Unix()))
+
+	tests := []struct {
+		name     string
+		required bool
+		remote   net.Addr
+		cookie   string // none if empty
+		answered bool   // by apply, with this rcode and TC flag
+		rcode    int
+		tc       bool
+	}{
+		{"no cookie", false, udp, "", false, 0, false},
+		{"no cookie, required", true, udp, "", true, dns.RcodeSuccess, true},
+		{"no cookie, required, over TCP", true, tcp, "", false, 0, false},
+		{"client cookie", false, udp, testClientCookie, false, 0, false},
+		{"client cookie, required", true, udp, testClientCookie, true, dns.RcodeBadCookie, false},
+		{"client cookie, required, over TCP", true, tcp, testClientCookie, false, 0, false},
+		{"valid cookie, required", true, udp, valid, false, 0, false},
+		{"malformed cookie", false, udp, "0123", true, dns.RcodeFormatError, false},
+	}
+	for _, tt := range tests {
+		sc.required = tt.required
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.", dns.TypeA)
+		if tt.cookie != "" {
+			setCookie(r, tt.cookie)
+		}
+		tw := &testWriter{remote: tt.remote}
+		w, ok := sc.apply(tw, r)
+		if ok == tt.answered {
+			t.Errorf("%s: let through %t, want %t", tt.name, ok, !tt.answered)
+			continue
+		}
+		if tt.answered {
+			if tw.msg == nil || tw.msg.Rcode != tt.rcode || tw.msg.Truncated != tt.tc {
+				t.Errorf("%s: answered %v, want %s with TC=%t", tt.name, tw.msg, dns.RcodeToString[tt.rcode], tt.tc)
+			}
+			continue
+		}
+
+		// the response carries a fresh server cookie when the client sent one
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		cookie := findCookie(tw.msg)
+		switch {
+		case tt.cookie == "" && cookie != nil:
+			t.Errorf("%s: cookie %s in the response, none asked", tt.name, cookie.Cookie)
+		case tt.cookie != "" && (cookie == nil || !sc.valid(cookie.Cookie, udp.IP)):
+			t.Errorf("%s: response cookie %v, want a valid one", tt.name, cookie)
+		}
+	}
+
+	// the BADCOOKIE answer gives the cookie to retry with
+	sc.required = true
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.", dns.TypeA)
+	setCookie(r, testClientCookie)
+	tw := &testWriter{remote: udp}
+	sc.apply(tw, r)
+	if cookie := findCookie(tw.msg); cookie == nil || !sc.valid(cookie.Cookie, udp.IP) {
+		t.Errorf("BADCOOKIE answer cookie %v, want a valid one", cookie)
+	}
+}
+
+func TestCookielessLimit(t *testing.T) {
+	sc := newTestServerCookies()
+	sc.limit = 3
+	ip, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	// the window is the current second: start early in one
+	for time.Now().Nanosecond() > 500_000_000 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := range sc.limit {
+		if sc.restricted(ip) {
+			t.Fatalf("query %d restricted, limit %d", i+1, sc.limit)
+		}
+	}
+	if !sc.restricted(ip) {
+		t.Error("query over the limit not restricted")
+	}
+	if sc.restricted(other) {
+		t.Error("another client restricted")
+	}
+
+	// the next second starts a new window
+	sc.mu.Lock()
+	sc.second--
+	sc.mu.Unlock()
+	if sc.restricted(ip) {
+		t.Error("restricted in a new window")
+	}
+
+	sc.limit = 0
+	for range 10 {
+		if sc.restricted(ip) {
+			t.Fatal("restricted without limit")
+		}
+	}
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	uc := &UpstreamCookies{servers: map[string]*upstreamCookie{}}
+	serv, err := parseServer("udp://192.0.2.53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	uc.add(serv, query)
+	sent := findCookie(query)
+	if sent == nil || len(sent.Cookie) != clientCookieLen {
+		t.Fatalf("query cookie %v, want a client cookie", sent)
+	}
+	client := sent.Cookie
+	serverCookie := "00112233445566778899aabbccddeeff"
+
+	tests := []struct {
+		name   string
+		cookie string // none if empty
+		ok     bool
+	}{
+		{"no cookie from a server without cookies", "", true},
+		{"other client cookie", "fedcba9876543210" + serverCookie, false},
+		{"short cookie", client[:8], false},
+		{"our client cookie", client, true},
+		{"server cookie", client + serverCookie, true},
+		{"no cookie once the server gave one", "", false},
+		{"other client cookie again", "fedcba9876543210" + serverCookie, false},
+	}
+	for _, tt := range tests {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		if tt.cookie != "" {
+			setCookie(resp, tt.cookie)
+		}
+		if err := uc.check(serv, resp); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want accepted %t", tt.name, err, tt.ok)
+		}
+	}
+
+	// the next queries carry the server cookie learned
+	query = new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	uc.add(serv, query)
+	if got := findCookie(query); got == nil || got.Cookie != client+serverCookie {
+		t.Errorf("query cookie %v, want %s", got, client+serverCookie)
+	}
+}
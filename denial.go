@@ -0,0 +1,354 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Aggressive use of the validated NSEC/NSEC3 records (RFC 8198)
+// =============================================================================
+
+// denialZone holds the validated NSEC/NSEC3 records of a zone, with its SOA
+// for the authority section of the synthesized answers. The records are
+// sorted, so that the one matching or covering a name is found by a binary
+// search: the NSEC by canonical order of their owners, the NSEC3 by their
+// owner hashes. A zone has a single NSEC3 chain, of the parameters kept
+// once here, so that a name is hashed once per query.
+type denialZone struct {
+	soa        denialSet
+	nsecs      []denialSet // by canonical owner name
+	nsec3s     []denialSet // by owner hash
+	hash       uint8       // NSEC3 parameters
+	iterations uint16
+	salt       string
+}
+
+type denialSet struct {
+	set    *rrset
+	expiry time.Time
+	owner  string // canonical owner name of an NSEC, owner hash of an NSEC3
+}
+
+// storeDenials keeps the NSEC/NSEC3 RRsets of a secure answer, to answer
+// later the queries for the names they prove don't exist. They are kept for
+// their TTL, at most the negative TTL of the zone (RFC 2308).
+func (v *Validator) storeDenials(sets []*rrset) {
+	var soa *rrset
+	for _, set := range sets {
+		if set.rrs[0].Header().Rrtype == dns.TypeSOA {
+			soa = set
+		}
+	}
+	if soa == nil {
+		return
+	}
+	zone := dns.CanonicalName(soa.rrs[0].Header().Name)
+	negTTL := min(soa.rrs[0].Header().Ttl, soa.rrs[0].(*dns.SOA).Minttl)
+	now := time.Now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	dz := v.denials[zone]
+	if dz == nil {
+		dz = &denialZone{}
+		v.denials[zone] = dz
+	}
+	dz.soa = denialSet{set: soa, expiry: now.Add(time.Duration(negTTL) * time.Second)}
+
+	for _, set := range sets {
+		h := set.rrs[0].Header()
+		if h.Rrtype != dns.TypeNSEC && h.Rrtype != dns.TypeNSEC3 || dns.CanonicalName(set.sigs[0].SignerName) != zone {
+			continue
+		}
+		d := denialSet{set: set, expiry: now.Add(time.Duration(min(h.Ttl, negTTL)) * time.Second)}
+		owner := dns.CanonicalName(h.Name)
+		switch rr := set.rrs[0].(type) {
+		case *dns.NSEC:
+			d.owner = owner
+			dz.nsecs = v.insertDenial(dz.nsecs, d, canonicalLess)
+		case *dns.NSEC3:
+			if parentName(owner) != zone {
+				continue
+			}
+			if rr.Hash != dz.hash || rr.Iterations != dz.iterations || !strings.EqualFold(rr.Salt, dz.salt) {
+				// new parameters, the former chain is of no use anymore
+				v.denialCount -= len(dz.nsec3s)
+				dz.nsec3s = nil
+				dz.hash, dz.iterations, dz.salt = rr.Hash, rr.Iterations, rr.Salt
+			}
+			d.owner = strings.ToUpper(owner[:strings.IndexByte(owner, '.')])
+			dz.nsec3s = v.insertDenial(dz.nsec3s, d, func(a, b string) bool { return a < b })
+		}
+	}
+}
+
+// insertDenial adds an RRset to a sorted index, or replaces the one of the
+// same owner, within maxDenialRecords. v.mu is held.
+func (v *Validator) insertDenial(index []denialSet, d denialSet, less func(a, b string) bool) []denialSet {
+	i := sort.Search(len(index), func(i int) bool { return !less(index[i].owner, d.owner) })
+	if i < len(index) && index[i].owner == d.owner {
+		index[i] = d
+		return index
+	}
+	if v.denialCount >= maxDenialRecords {
+		return index
+	}
+	v.denialCount++
+	return slices.Insert(index, i, d)
+}
+
+// nsecAt returns the unexpired NSEC RRset whose owner is name or the
+// closest before it in canonical order: the only one that can match or
+// cover it.
+func (dz *denialZone) nsecAt(name string, now time.Time) (denialSet, bool) {
+	i := sort.Search(len(dz.nsecs), func(i int) bool { return canonicalLess(name, dz.nsecs[i].owner) })
+	if i == 0 || dz.nsecs[i-1].expiry.Before(now) {
+		return denialSet{}, false
+	}
+	return dz.nsecs[i-1], true
+}
+
+// nsec3At returns the unexpired NSEC3 RRset whose owner hash is hash or
+// the closest before it, the last of the chain for the hashes before the
+// first.
+func (dz *denialZone) nsec3At(hash string, now time.Time) (denialSet, bool) {
+	if len(dz.nsec3s) == 0 {
+		return denialSet{}, false
+	}
+	i := sort.Search(len(dz.nsec3s), func(i int) bool { return hash < dz.nsec3s[i].owner })
+	if i == 0 {
+		i = len(dz.nsec3s)
+	}
+	d := dz.nsec3s[i-1]
+	return d, d.expiry.After(now)
+}
+
+// synthesize answers a query from the cached NSEC/NSEC3 records when they
+// prove that the name (NXDOMAIN) or the type (NODATA) doesn't exist.
+// It returns nil otherwise.
+func (v *Validator) synthesize(r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	now := time.Now()
+
+	v.mu.Lock()
+	zone := name
+	dz := v.denials[zone]
+	for dz == nil && zone != "." {
+		zone = parentName(zone)
+		dz = v.denials[zone]
+	}
+	if dz == nil || dz.soa.expiry.Before(now) {
+		v.mu.Unlock()
+		return nil
+	}
+	hash, iterations, salt := dz.hash, dz.iterations, dz.salt
+	hashed := len(dz.nsec3s) > 0
+	v.mu.Unlock()
+
+	// a proof is about the name, its ancestors in the zone and the
+	// wildcards that could match it
+	var names []string
+	for n := name; ; n = parentName(n) {
+		names = append(names, n, "*."+n)
+		if n == zone {
+			break
+		}
+	}
+	hashes := map[string]string{}
+	if hashed {
+		for _, n := range names {
+			hashes[n] = dns.HashName(n, hash, iterations, salt)
+		}
+	}
+
+	// the records matching or covering these names
+	var proof []denialSet
+	var nsecs []dns.RR
+	found := map[string]nsec3Lookup{}
+	seen := map[*rrset]bool{}
+	keep := func(d denialSet) {
+		if !seen[d.set] {
+			seen[d.set] = true
+			proof = append(proof, d)
+		}
+	}
+	v.mu.Lock()
+	if dz.hash != hash || dz.iterations != iterations || dz.salt != salt {
+		hashes = nil // the chain changed meanwhile
+	}
+	for _, n := range names {
+		if d, ok := dz.nsecAt(n, now); ok && (d.owner == n || nsecCovers(d.set.rrs[0].(*dns.NSEC), n)) {
+			if !seen[d.set] {
+				nsecs = append(nsecs, d.set.rrs...)
+			}
+			keep(d)
+		}
+		if h, ok := hashes[n]; ok {
+			d, ok := dz.nsec3At(h, now)
+			l := nsec3Lookup{hash: h, set: d, ok: ok}
+			if l.matches() || l.covers() {
+				found[n] = l
+				keep(d)
+			}
+		}
+	}
+	soa := dz.soa
+	v.mu.Unlock()
+
+	var rcode int
+	switch {
+	case denyName(name, nsecs) == secSecure:
+		rcode = dns.RcodeNameError
+	case denyType(name, q.Qtype, nsecs) == secSecure:
+		rcode = dns.RcodeSuccess
+	default:
+		var ok bool
+		if rcode, ok = denyHashed(name, q.Qtype, zone, found); !ok {
+			return nil
+		}
+	}
+	log.Debugf("DNSSEC: %s %s synthesized from the NSEC records of %s", q.Name, dns.TypeToString[q.Qtype], zone)
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.RecursionAvailable = true
+	m.AuthenticatedData = true
+	do := r.IsEdns0() != nil && r.IsEdns0().Do()
+	m.Ns = soa.records(do, soa.expiry)
+	if do {
+		for _, d := range proof {
+			expiry := d.expiry
+			if soa.expiry.Before(expiry) {
+				expiry = soa.expiry
+			}
+			m.Ns = append(m.Ns, d.records(true, expiry)...)
+		}
+	}
+	if r.IsEdns0() != nil {
+		m.SetEdns0(ednsUDPSize, do)
+	}
+	return m
+}
+
+// nsec3Lookup is the NSEC3 RRset found for the hash of a name.
+type nsec3Lookup struct {
+	hash string
+	set  denialSet
+	ok   bool
+}
+
+func (l nsec3Lookup) nsec3() *dns.NSEC3 {
+	return l.set.set.rrs[0].(*dns.NSEC3)
+}
+
+// matches reports whether the owner hash of the NSEC3 is the hash: the
+// name exists.
+func (l nsec3Lookup) matches() bool {
+	return l.ok && l.set.owner == l.hash
+}
+
+// covers reports whether the hash falls strictly between the owner and the
+// next hash of the NSEC3: the name doesn't exist.
+func (l nsec3Lookup) covers() bool {
+	if !l.ok {
+		return false
+	}
+	owner, next := l.set.owner, strings.ToUpper(l.nsec3().NextDomain)
+	if owner < next {
+		return owner < l.hash && l.hash < next
+	}
+	// the last NSEC3 of the chain wraps around to the first hash
+	return owner < l.hash || l.hash < next
+}
+
+// denyHashed checks the NSEC3 proof of a NXDOMAIN or of a NODATA, as
+// denyName and denyType do, from the NSEC3 found for the names of the proof.
+// It returns the rcode of the answer, and false without a secure proof.
+func denyHashed(name string, qtype uint16, zone string, found map[string]nsec3Lookup) (int, bool) {
+	noType := func(l nsec3Lookup) bool {
+		bitmap := l.nsec3().TypeBitMap
+		return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+	}
+	if l := found[name]; l.matches() {
+		return dns.RcodeSuccess, noType(l)
+	}
+	// closest encloser proof (RFC 5155 8.3)
+	for nextCloser, ce := name, name; ce != zone; {
+		nextCloser, ce = ce, parentName(ce)
+		l := found[ce]
+		if !l.matches() {
+			continue
+		}
+		cover := found[nextCloser]
+		if cutsZone(l.nsec3().TypeBitMap) || !cover.covers() {
+			return 0, false
+		}
+		optOut := cover.nsec3().Flags&1 != 0
+		switch wildcard := found["*."+ce]; {
+		case wildcard.covers() && !optOut:
+			return dns.RcodeNameError, true
+		case wildcard.matches() && noType(wildcard) && !(optOut && qtype == dns.TypeDS):
+			return dns.RcodeSuccess, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// records returns a copy of the RRset, and of its signatures with sigs,
+// with the TTL left until expiry.
+func (d denialSet) records(sigs bool, expiry time.Time) []dns.RR {
+	ttl := uint32(time.Until(expiry).Seconds())
+	var rrs []dns.RR
+	for _, rr := range d.set.rrs {
+		rrs = append(rrs, dns.Copy(rr))
+	}
+	if sigs {
+		for _, sig := range d.set.sigs {
+			rrs = append(rrs, dns.Copy(sig))
+		}
+	}
+	for _, rr := range rrs {
+		rr.Header().Ttl = ttl
+	}
+	return rrs
+}
+
+// pruneDenials removes the expired records, v.mu being held.
+func (v *Validator) pruneDenials(now time.Time) {
+	for zone, dz := range v.denials {
+		dz.nsecs = v.pruneIndex(dz.nsecs, now)
+		dz.nsec3s = v.pruneIndex(dz.nsec3s, now)
+		if len(dz.nsecs) == 0 && len(dz.nsec3s) == 0 {
+			delete(v.denials, zone)
+		}
+	}
+}
+
+func (v *Validator) pruneIndex(index []denialSet, now time.Time) []denialSet {
+	kept := index[:0]
+	for _, d := range index {
+		if d.expiry.Before(now) {
+			v.denialCount--
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// flushDenials forgets every NSEC/NSEC3 record, so that names added to
+// their zones since are asked upstream.
+func (v *Validator) flushDenials() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.denials = map[string]*denialZone{}
+	v.denialCount = 0
+}
@@ -0,0 +1,945 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// DNSSEC validation
+// =============================================================================
+
+type secStatus int
+
+// ordered from the worst to the best, so that min() combines them
+const (
+	secBogus secStatus = iota
+	secInsecure
+	secSecure
+)
+
+func (s secStatus) String() string {
+	switch s {
+	case secSecure:
+		return "secure"
+	case secInsecure:
+		return "insecure"
+	}
+	return "bogus"
+}
+
+// secResult is a cached step of the chain of trust: the keys of a zone, or
+// the DS records of a name.
+type secResult struct {
+	status secStatus
+	cut    bool // the name is a zone cut (DS lookups)
+	keys   []*dns.DNSKEY
+	ds     []*dns.DS
+	expiry time.Time
+}
+
+// Validator checks the answers of the upstream servers against the chain
+// of trust starting at the root trust anchors. DNSKEY and DS records are
+// fetched through the forwarder, like any other query.
+type Validator struct {
+	fw          *Forwarder
+	anchors     *TrustAnchors
+	mu          sync.Mutex
+	keys        map[string]secResult   // by zone
+	ds          map[string]secResult   // by child name
+	denials     map[string]*denialZone // by zone, aggressive NSEC cache
+	denialCount int
+}
+
+func newValidator(fw *Forwarder, anchors *TrustAnchors) *Validator {
+	return &Validator{
+		fw:      fw,
+		anchors: anchors,
+		keys:    map[string]secResult{},
+		ds:      map[string]secResult{},
+		denials: map[string]*denialZone{},
+	}
+}
+
+// forwardValidated resolves the request with checking disabled, validates
+// the answer, then shapes it for the client: AD set on secure answers,
+// SERVFAIL on bogus ones, DNSSEC records removed if the client didn't ask
+// for them. Names proven not to exist by cached NSEC records are answered
+// without asking upstream. It returns the source of the answer too.
+func (fw *Forwarder) forwardValidated(zone *Forward, r *dns.Msg) (*dns.Msg, string) {
+	if resp := fw.validator.synthesize(r); resp != nil {
+		return resp, sourceNSEC
+	}
+	query := r.Copy()
+	query.CheckingDisabled = true
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(ednsUDPSize, true)
+	}
+	resp, source := fw.resolve(zone, query)
+	if resp == nil {
+		return nil, ""
+	}
+
+	q := r.Question[0]
+	status := fw.validator.validate(q, resp)
+	log.Debugf("DNSSEC: %s %s is %s", q.Name, dns.TypeToString[q.Qtype], status)
+	if status == secBogus {
+		log.Infof("DNSSEC: %s %s is bogus", q.Name, dns.TypeToString[q.Qtype])
+		return bogusReply(r), source
+	}
+
+	resp.CheckingDisabled = false
+	resp.AuthenticatedData = status == secSecure
+	clientOpt := r.IsEdns0()
+	if clientOpt == nil || !clientOpt.Do() {
+		stripDNSSEC(resp, q.Qtype)
+	}
+	if clientOpt == nil {
+		resp.Extra = removeType(resp.Extra, dns.TypeOPT, 0)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(clientOpt.Do())
+	}
+	fw.setCache(r, resp, zone.Name)
+	return resp, source
+}
+
+// bogusReply is the SERVFAIL answered to a query failing validation, with
+// an extended DNS error (RFC 8914) for EDNS clients.
+func bogusReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	if clientOpt := r.IsEdns0(); clientOpt != nil {
+		m.SetEdns0(ednsUDPSize, clientOpt.Do())
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+	}
+	return m
+}
+
+// stripDNSSEC removes the DNSSEC records a client without DO did not ask for.
+func stripDNSSEC(resp *dns.Msg, qtype uint16) {
+	for _, t := range []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3} {
+		resp.Answer = removeType(resp.Answer, t, qtype)
+		resp.Ns = removeType(resp.Ns, t, 0)
+		resp.Extra = removeType(resp.Extra, t, 0)
+	}
+}
+
+// removeType removes the records of type t from a section, unless t is keep.
+func removeType(section []dns.RR, t uint16, keep uint16) []dns.RR {
+	if t == keep {
+		return section
+	}
+	var kept []dns.RR
+	for _, rr := range section {
+		if rr.Header().Rrtype != t {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// lookup resolves a record needed for validation, with checking disabled.
+// DS records live in the parent zone, so they are routed by the parent name.
+func (fw *Forwarder) lookup(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(ednsUDPSize, true)
+	m.CheckingDisabled = true
+
+	route := name
+	if qtype == dns.TypeDS {
+		route = parentName(name)
+	}
+	zone := fw.zoneOrDefault(fw.findZoneByFQDN(strings.TrimSuffix(route, ".")))
+	resp, _ := fw.resolve(zone, m)
+	if resp == nil {
+		log.Debugf("DNSSEC: no answer for %s %s", name, dns.TypeToString[qtype])
+	}
+	return resp
+}
+
+// negativeAnchor reports whether validation is disabled for the name (nta).
+func (fw *Forwarder) negativeAnchor(name string) bool {
+	zone := fw.findZoneByFQDN(strings.TrimSuffix(name, "."))
+	return zone != nil && zone.NTA
+}
+
+// =============================================================================
+// Answers
+// =============================================================================
+
+// validate returns the security status of an answer to the question q.
+// Every RRset of the answer must be signed by its zone, unless the zone is
+// provably insecure. Negative answers and wildcard expansions must come
+// with a signed proof of the non-existence (NSEC or NSEC3).
+func (v *Validator) validate(q dns.Question, resp *dns.Msg) secStatus {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return secInsecure
+	}
+
+	type expansion struct {
+		owner  string
+		labels int
+	}
+	var expanded []expansion
+	status := secSecure
+	sets := rrsets(resp.Answer)
+	for _, set := range sets {
+		if synthesized(set, sets) {
+			continue // CNAME made from a DNAME, checked with the DNAME
+		}
+		st, labels := v.verify(set, "")
+		if st == secBogus {
+			return secBogus
+		}
+		status = min(status, st)
+		owner := dns.CanonicalName(set.rrs[0].Header().Name)
+		if st == secSecure && labels < dns.CountLabel(owner) && !strings.HasPrefix(owner, "*.") {
+			expanded = append(expanded, expansion{owner, labels})
+		}
+	}
+
+	// follow the CNAME chain to the name actually answered
+	target := dns.CanonicalName(q.Name)
+	positive := false
+	for range sets {
+		next := ""
+		for _, set := range sets {
+			h := set.rrs[0].Header()
+			if dns.CanonicalName(h.Name) != target {
+				continue
+			}
+			switch {
+			case h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+				positive = true
+			case h.Rrtype == dns.TypeCNAME:
+				next = dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+		if positive || next == "" {
+			break
+		}
+		target = next
+	}
+	if positive && len(expanded) == 0 {
+		return status
+	}
+
+	authStatus, secure := v.verifyAuthority(resp.Ns, target, "")
+	if authStatus != secSecure {
+		return min(status, authStatus)
+	}
+	nsecs := nsecRecords(secure)
+	if costlyNSEC3(nsecs) {
+		log.Debugf("DNSSEC: %s: more than %d NSEC3 iterations, insecure", target, maxNSEC3Iterations)
+		return min(status, secInsecure)
+	}
+	for _, e := range expanded {
+		if !denyCloserMatch(e.owner, e.labels, nsecs) {
+			log.Debugf("DNSSEC: %s: no proof for the wildcard expansion", e.owner)
+			return secBogus
+		}
+	}
+	if !positive {
+		var st secStatus
+		if resp.Rcode == dns.RcodeNameError {
+			st = denyName(target, nsecs)
+		} else {
+			st = denyType(target, q.Qtype, nsecs)
+		}
+		if st == secBogus {
+			log.Debugf("DNSSEC: %s: no proof of non-existence", target)
+		}
+		status = min(status, st)
+	}
+	if status == secSecure {
+		v.storeDenials(secure)
+	}
+	return status
+}
+
+// verifyAuthority checks the SOA, NSEC and NSEC3 records of an authority
+// section and returns the RRsets found secure. name is the name the section
+// is about, above is passed to verify.
+func (v *Validator) verifyAuthority(section []dns.RR, name, above string) (secStatus, []*rrset) {
+	status := secSecure
+	found := false
+	var secure []*rrset
+	for _, set := range rrsets(section) {
+		t := set.rrs[0].Header().Rrtype
+		if t != dns.TypeSOA && t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		if above != "" && t == dns.TypeSOA && dns.IsSubDomain(above, set.rrs[0].Header().Name) {
+			continue // answered by the child side of the cut
+		}
+		found = true
+		st, _ := v.verify(set, above)
+		status = min(status, st)
+		if st == secSecure {
+			secure = append(secure, set)
+		}
+	}
+	if !found {
+		if above != "" {
+			name = parentName(above)
+		}
+		if status = v.zoneStatus(name); status == secSecure {
+			status = secBogus // a secure zone must prove what it denies
+		}
+	}
+	return status, secure
+}
+
+// nsecRecords returns the NSEC and NSEC3 records of RRsets.
+func nsecRecords(sets []*rrset) []dns.RR {
+	var nsecs []dns.RR
+	for _, set := range sets {
+		if t := set.rrs[0].Header().Rrtype; t == dns.TypeNSEC || t == dns.TypeNSEC3 {
+			nsecs = append(nsecs, set.rrs...)
+		}
+	}
+	return nsecs
+}
+
+// verify checks the signatures of an RRset and returns its status, with
+// the number of labels of the signature to spot wildcard expansions.
+//
+// above is set when the RRset must come from a zone above that name (the
+// DS records of a name and the proofs of their absence). It is implied
+// for DS RRsets.
+func (v *Validator) verify(set *rrset, above string) (secStatus, int) {
+	h := set.rrs[0].Header()
+	owner := dns.CanonicalName(h.Name)
+	if above == "" && h.Rrtype == dns.TypeDS {
+		above = owner
+	}
+	if v.fw.negativeAnchor(owner) {
+		return secInsecure, 0
+	}
+
+	if len(set.sigs) == 0 {
+		zone := owner
+		switch {
+		case above != "":
+			zone = parentName(above)
+		case h.Rrtype == dns.TypeNSEC || h.Rrtype == dns.TypeNSEC3:
+			zone = parentName(owner)
+		}
+		if st := v.zoneStatus(zone); st != secInsecure {
+			log.Debugf("DNSSEC: %s %s is not signed", owner, dns.TypeToString[h.Rrtype])
+			return secBogus, 0
+		}
+		return secInsecure, 0
+	}
+
+	now := time.Now()
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		if above != "" && dns.IsSubDomain(above, signer) {
+			continue
+		}
+		keys := v.zoneKeys(signer)
+		switch keys.status {
+		case secInsecure:
+			return secInsecure, 0
+		case secBogus:
+			continue
+		}
+		for _, key := range keys.keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set.rrs) == nil {
+				return secSecure, int(sig.Labels)
+			}
+		}
+	}
+	log.Debugf("DNSSEC: %s %s has no valid signature", owner, dns.TypeToString[h.Rrtype])
+	return secBogus, 0
+}
+
+// synthesized reports whether a CNAME RRset was synthesized from a DNAME
+// of the answer. Such CNAMEs are not signed.
+func synthesized(set *rrset, sets []*rrset) bool {
+	cname, ok := set.rrs[0].(*dns.CNAME)
+	if !ok || len(set.sigs) != 0 {
+		return false
+	}
+	owner := dns.CanonicalName(cname.Hdr.Name)
+	for _, s := range sets {
+		dname, ok := s.rrs[0].(*dns.DNAME)
+		if !ok {
+			continue
+		}
+		from := dns.CanonicalName(dname.Hdr.Name)
+		if owner == from || !dns.IsSubDomain(from, owner) {
+			continue
+		}
+		prefix := strings.TrimSuffix(owner, from)
+		if prefix+dns.CanonicalName(dname.Target) == dns.CanonicalName(cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// =============================================================================
+// Chain of trust
+// =============================================================================
+
+// zoneStatus tells whether a name is in a signed zone, walking the
+// delegations from the root down to the name.
+func (v *Validator) zoneStatus(name string) secStatus {
+	if v.fw.negativeAnchor(name) {
+		return secInsecure
+	}
+	if st := v.zoneKeys(".").status; st != secSecure {
+		return st
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		res := v.dsLookup(zone)
+		if res.status != secSecure {
+			return res.status
+		}
+		if res.cut && len(res.ds) == 0 {
+			return secInsecure // unsupported algorithms
+		}
+	}
+	return secSecure
+}
+
+// zoneKeys returns the validated DNSKEYs of a zone.
+func (v *Validator) zoneKeys(zone string) secResult {
+	zone = dns.CanonicalName(zone)
+	if res, ok := v.cached(v.keys, zone); ok {
+		return res
+	}
+	res := v.fetchKeys(zone)
+	v.store(v.keys, zone, res)
+	return res
+}
+
+// fetchKeys fetches the DNSKEYs of a zone and checks them against the DS
+// records of the parent, or the trust anchors for the root.
+func (v *Validator) fetchKeys(zone string) secResult {
+	var ds []*dns.DS
+	if zone != "." {
+		res := v.dsLookup(zone)
+		if res.status != secSecure {
+			return secResult{status: res.status, expiry: res.expiry}
+		}
+		if !res.cut {
+			log.Debugf("DNSSEC: %s is not a zone", zone)
+			return secResult{status: secBogus, expiry: res.expiry}
+		}
+		if ds = res.ds; len(ds) == 0 {
+			// only unsupported algorithms, handled as unsigned (RFC 4035 5.2)
+			return secResult{status: secInsecure, expiry: res.expiry}
+		}
+	}
+
+	resp := v.fw.lookup(zone, dns.TypeDNSKEY)
+	if resp == nil {
+		return secResult{status: secBogus, expiry: secExpiry(nil)}
+	}
+	var keys []*dns.DNSKEY
+	var set rrset
+	for _, rr := range resp.Answer {
+		if dns.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			set.rrs = append(set.rrs, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				set.sigs = append(set.sigs, rr)
+			}
+		}
+	}
+
+	var trusted []*dns.DNSKEY
+	if zone == "." {
+		trusted = v.anchors.trusted(keys)
+	} else {
+		for _, k := range keys {
+			if k.Flags&dns.REVOKE == 0 && matchDS(k, ds) {
+				trusted = append(trusted, k)
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range trusted {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, set.rrs) == nil {
+				if zone == "." {
+					v.anchors.update(keys, set.rrs, set.sigs)
+				}
+				return secResult{status: secSecure, cut: true, keys: keys, expiry: secExpiry(set.rrs)}
+			}
+		}
+	}
+	log.Debugf("DNSSEC: no trusted key for %s", zone)
+	return secResult{status: secBogus, expiry: secExpiry(nil)}
+}
+
+// dsLookup returns the validated DS records of a name. Secure results tell
+// whether the name is a zone cut; insecure ones mean an unsigned delegation
+// (or an insecure parent).
+func (v *Validator) dsLookup(child string) secResult {
+	child = dns.CanonicalName(child)
+	if res, ok := v.cached(v.ds, child); ok {
+		return res
+	}
+	res := v.fetchDS(child)
+	v.store(v.ds, child, res)
+	return res
+}
+
+func (v *Validator) fetchDS(child string) secResult {
+	resp := v.fw.lookup(child, dns.TypeDS)
+	if resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return secResult{status: secBogus, expiry: secExpiry(nil)}
+	}
+
+	for _, set := range rrsets(resp.Answer) {
+		h := set.rrs[0].Header()
+		if dns.CanonicalName(h.Name) != child {
+			continue
+		}
+		switch h.Rrtype {
+		case dns.TypeDS:
+			st, _ := v.verify(set, child)
+			res := secResult{status: st, cut: true, expiry: secExpiry(set.rrs)}
+			for _, rr := range set.rrs {
+				if ds := rr.(*dns.DS); supportedDS(ds) {
+					res.ds = append(res.ds, ds)
+				}
+			}
+			return res
+		case dns.TypeCNAME:
+			// an alias can't be a zone cut
+			st, _ := v.verify(set, child)
+			return secResult{status: st, expiry: secExpiry(set.rrs)}
+		}
+	}
+
+	st, secure := v.verifyAuthority(resp.Ns, child, child)
+	if st != secSecure {
+		return secResult{status: st, expiry: secExpiry(resp.Ns)}
+	}
+	nsecs := nsecRecords(secure)
+	if costlyNSEC3(nsecs) {
+		log.Debugf("DNSSEC: %s: more than %d NSEC3 iterations, insecure", child, maxNSEC3Iterations)
+		return secResult{status: secInsecure, expiry: secExpiry(nsecs)}
+	}
+	return denyDS(child, nsecs)
+}
+
+// denyDS interprets the proof that a name has no DS record: an unsigned
+// delegation (insecure), a name that is not a zone cut (secure, no cut) or
+// no proof at all (bogus).
+func denyDS(child string, nsecs []dns.RR) secResult {
+	res := secResult{status: secBogus, expiry: secExpiry(nsecs)}
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(rr.Hdr.Name) == child {
+				switch {
+				case hasType(rr.TypeBitMap, dns.TypeDS), hasType(rr.TypeBitMap, dns.TypeSOA):
+					return res
+				case hasType(rr.TypeBitMap, dns.TypeNS):
+					res.status = secInsecure
+				default:
+					res.status = secSecure
+				}
+				return res
+			}
+			if nsecCovers(rr, child) {
+				res.status = secSecure // no such name, so no cut
+				return res
+			}
+		case *dns.NSEC3:
+			if rr.Match(child) {
+				switch {
+				case hasType(rr.TypeBitMap, dns.TypeDS), hasType(rr.TypeBitMap, dns.TypeSOA):
+					return res
+				case hasType(rr.TypeBitMap, dns.TypeNS):
+					res.status = secInsecure
+				default:
+					res.status = secSecure
+				}
+				return res
+			}
+		}
+	}
+	if _, optOut, ok := nsec3ClosestEncloser(child, nsecs); ok {
+		res.status = secSecure
+		if optOut {
+			res.status = secInsecure // possibly an unsigned delegation
+		}
+	}
+	return res
+}
+
+func supportedDS(ds *dns.DS) bool {
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+	default:
+		return false
+	}
+	switch ds.Algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func matchDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kds := k.ToDS(d.DigestType); kds != nil && kds.KeyTag == d.KeyTag && strings.EqualFold(kds.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Validator) cached(m map[string]secResult, name string) (secResult, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	res, ok := m[name]
+	if !ok || res.expiry.Before(time.Now()) {
+		return secResult{}, false
+	}
+	return res, true
+}
+
+func (v *Validator) store(m map[string]secResult, name string, res secResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m[name] = res
+}
+
+// prune removes the expired keys and DS records.
+func (v *Validator) prune() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for _, m := range []map[string]secResult{v.keys, v.ds} {
+		for name, res := range m {
+			if res.expiry.Before(now) {
+				delete(m, name)
+			}
+		}
+	}
+	v.pruneDenials(now)
+}
+
+// secExpiry returns when a result built from records expires: at their
+// lowest TTL, bounded by dnssecMinTTL and dnssecMaxTTL.
+func secExpiry(rrs []dns.RR) time.Time {
+	ttl := uint32(dnssecMaxTTL)
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	ttl = max(ttl, dnssecMinTTL)
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// =============================================================================
+// Denial of existence
+// =============================================================================
+
+// denyName checks the proof of a NXDOMAIN: the name and the wildcard that
+// could have matched it don't exist.
+func denyName(name string, nsecs []dns.RR) secStatus {
+	for _, rr := range nsecs {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) {
+			if nsecDenies(nsecs, "*."+nsecEncloser(nsec, name)) {
+				return secSecure
+			}
+		}
+	}
+	if ce, optOut, ok := nsec3ClosestEncloser(name, nsecs); ok && nsec3Covered(nsecs, "*."+ce) {
+		if optOut {
+			return secInsecure
+		}
+		return secSecure
+	}
+	return secBogus
+}
+
+// denyType checks the proof of a NODATA: the name (or the wildcard matching
+// it) exists but has no record of type qtype.
+func denyType(name string, qtype uint16, nsecs []dns.RR) secStatus {
+	noType := func(bitmap []uint16) bool {
+		return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+	}
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			owner := dns.CanonicalName(rr.Hdr.Name)
+			next := dns.CanonicalName(rr.NextDomain)
+			switch {
+			case owner == name && noType(rr.TypeBitMap):
+				return secSecure
+			case nsecCovers(rr, name) && next != name && dns.IsSubDomain(name, next):
+				return secSecure // empty non-terminal
+			case nsecCovers(rr, name):
+				wildcard := "*." + nsecEncloser(rr, name)
+				for _, w := range nsecs {
+					if w, ok := w.(*dns.NSEC); ok && dns.CanonicalName(w.Hdr.Name) == wildcard && noType(w.TypeBitMap) {
+						return secSecure
+					}
+				}
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				if noType(rr.TypeBitMap) {
+					return secSecure
+				}
+				return secBogus
+			}
+		}
+	}
+	if ce, optOut, ok := nsec3ClosestEncloser(name, nsecs); ok {
+		if optOut && qtype == dns.TypeDS {
+			return secInsecure
+		}
+		for _, rr := range nsecs {
+			if rr, ok := rr.(*dns.NSEC3); ok && rr.Match("*."+ce) && noType(rr.TypeBitMap) {
+				return secSecure
+			}
+		}
+	}
+	return secBogus
+}
+
+// denyCloserMatch checks that a wildcard expansion was legitimate: no name
+// closer to owner than the wildcard exists. labels is the label count of
+// the signature, i.e. of the closest encloser.
+func denyCloserMatch(owner string, labels int, nsecs []dns.RR) bool {
+	if nsecDenies(nsecs, owner) {
+		return true
+	}
+	// the next closer name is the closest encloser plus one label of owner
+	indexes := dns.Split(owner)
+	nextCloser := owner[indexes[len(indexes)-labels-1]:]
+	return nsec3Covered(nsecs, nextCloser)
+}
+
+// nsecDenies reports whether an NSEC record proves that name doesn't exist.
+func nsecDenies(nsecs []dns.RR, name string) bool {
+	for _, rr := range nsecs {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the owner and the
+// next name of an NSEC record, in canonical order (RFC 4034 6.1).
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if !canonicalLess(owner, name) {
+		return false
+	}
+	// the names below a delegation or a DNAME are not in the zone
+	if dns.IsSubDomain(owner, name) && cutsZone(nsec.TypeBitMap) {
+		return false
+	}
+	// the last NSEC of a zone points back to the apex
+	return canonicalLess(name, next) || !canonicalLess(owner, next)
+}
+
+// nsecEncloser returns the closest encloser of a name covered by an NSEC:
+// the longest ancestor shared with the owner or the next name.
+func nsecEncloser(nsec *dns.NSEC, name string) string {
+	ce := "."
+	for _, other := range []string{nsec.Hdr.Name, nsec.NextDomain} {
+		other = dns.CanonicalName(other)
+		for !dns.IsSubDomain(other, name) {
+			other = parentName(other)
+		}
+		if dns.CountLabel(other) > dns.CountLabel(ce) {
+			ce = other
+		}
+	}
+	return ce
+}
+
+// canonicalLess compares two names in DNSSEC canonical order: label by
+// label from the right, as unescaped octets, case insensitive.
+func canonicalLess(a, b string) bool {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= min(len(la), len(lb)); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// canonicalLabels returns the labels of a name as octets, \DDD escapes
+// decoded and ASCII letters lowercased.
+func canonicalLabels(name string) [][]byte {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	var labels [][]byte
+	for i := 0; i < n && buf[i] != 0; i += int(buf[i]) + 1 {
+		label := buf[i+1 : i+1+int(buf[i])]
+		for j, c := range label {
+			if 'A' <= c && c <= 'Z' {
+				label[j] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// nsec3ClosestEncloser looks for the closest encloser proof of a name
+// (RFC 5155 8.3): an ancestor matched by an NSEC3, and the next closer name
+// covered by another. optOut is the opt-out flag of the covering NSEC3.
+func nsec3ClosestEncloser(name string, nsecs []dns.RR) (ce string, optOut bool, ok bool) {
+	nextCloser := name
+	for ce = parentName(name); ; ce = parentName(ce) {
+		for _, rr := range nsecs {
+			if nsec3, isNSEC3 := rr.(*dns.NSEC3); isNSEC3 && nsec3.Match(ce) {
+				if cutsZone(nsec3.TypeBitMap) {
+					return "", false, false
+				}
+				for _, rr := range nsecs {
+					if cover, isNSEC3 := rr.(*dns.NSEC3); isNSEC3 && nsec3Covers(cover, nextCloser) {
+						return ce, cover.Flags&1 != 0, true
+					}
+				}
+				return "", false, false
+			}
+		}
+		if ce == "." {
+			return "", false, false
+		}
+		nextCloser = ce
+	}
+}
+
+// costlyNSEC3 reports whether NSEC3 records ask for more hash iterations
+// than maxNSEC3Iterations: a hostile zone could make every proof expensive.
+func costlyNSEC3(nsecs []dns.RR) bool {
+	for _, rr := range nsecs {
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Iterations > maxNSEC3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Covers reports whether the hash of name falls strictly between the
+// owner and the next hash of an NSEC3 record. dns.NSEC3.Cover also accepts
+// the owner itself, i.e. a name that exists.
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+func nsec3Covered(nsecs []dns.RR, name string) bool {
+	for _, rr := range nsecs {
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3Covers(nsec3, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutsZone reports whether the names below an NSEC/NSEC3 owner are out of
+// its zone: the owner is a delegation or a DNAME.
+func cutsZone(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) || hasType(bitmap, dns.TypeDNAME)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// parentName returns the name without its first label.
+func parentName(name string) string {
+	if off, end := dns.NextLabel(name, 0); !end {
+		return name[off:]
+	}
+	return "."
+}
+
+// =============================================================================
+// RRsets
+// =============================================================================
+
+// rrset is a set of records of the same name, type and class, with the
+// signatures covering it.
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups the records of a section, in order of appearance.
+func rrsets(section []dns.RR) []*rrset {
+	var sets []*rrset
+	index := map[string]*rrset{}
+	get := func(h *dns.RR_Header, t uint16) *rrset {
+		key := dns.CanonicalName(h.Name) + "/" + dns.TypeToString[t] + "/" + dns.ClassToString[h.Class]
+		set, ok := index[key]
+		if !ok {
+			set = new(rrset)
+			index[key] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+	for _, rr := range section {
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			set := get(&rr.Hdr, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		case *dns.OPT:
+		default:
+			set := get(rr.Header(), rr.Header().Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// drop the signatures without records
+	kept := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			kept = append(kept, set)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Signed test zones
+// =============================================================================
+
+// testZone is a zone served by a testUpstream. It is signed, with an NSEC
+// or NSEC3 chain, when it has a key.
+type testZone struct {
+	name       string
+	key        *dns.DNSKEY
+	signer     crypto.Signer
+	nsec3      bool
+	iterations uint16
+	rrs        []dns.RR // records, then signatures and NSEC/NSEC3 once signed
+}
+
+// newTestZone returns a zone with a SOA and the given records, with a key
+// if signed.
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{name: name}
+	z.add(t, fmt.Sprintf("%s 300 IN SOA %s %s 1 3600 600 86400 300", name, childOf("ns", name), childOf("hostmaster", name)))
+	for _, record := range records {
+		z.add(t, record)
+	}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.signer = priv.(crypto.Signer)
+		z.rrs = append(z.rrs, z.key)
+	}
+	return z
+}
+
+func (z *testZone) add(t *testing.T, record string) {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.rrs = append(z.rrs, rr)
+}
+
+// childOf returns the name of a label in zone.
+func childOf(label, zone string) string {
+	if zone == "." {
+		return label + "."
+	}
+	return label + "." + zone
+}
+
+// delegate adds the NS record of a child zone, and its DS if it is signed.
+func (z *testZone) delegate(t *testing.T, child *testZone) {
+	t.Helper()
+	z.add(t, fmt.Sprintf("%s 300 IN NS ns.%s", child.name, child.name))
+	if child.key != nil {
+		z.rrs = append(z.rrs, child.key.ToDS(dns.SHA256))
+	}
+}
+
+// sign adds the NSEC or NSEC3 chain and the signatures of the RRsets, the
+// NS records of the delegations excepted.
+func (z *testZone) sign(t *testing.T) {
+	t.Helper()
+	types := map[string][]uint16{}
+	for _, rr := range z.rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !slices.Contains(types[owner], rr.Header().Rrtype) {
+			types[owner] = append(types[owner], rr.Header().Rrtype)
+		}
+	}
+	owners := make([]string, 0, len(types))
+	for owner := range types {
+		owners = append(owners, owner)
+	}
+
+	if z.nsec3 {
+		salt := "aabb"
+		hashes := map[string]string{}
+		for _, owner := range owners {
+			hashes[dns.HashName(owner, dns.SHA1, z.iterations, salt)] = owner
+		}
+		sorted := make([]string, 0, len(hashes))
+		for hash := range hashes {
+			sorted = append(sorted, hash)
+		}
+		slices.Sort(sorted)
+		for i, hash := range sorted {
+			bitmap := append(slices.Clone(types[hashes[hash]]), dns.TypeRRSIG)
+			slices.Sort(bitmap)
+			z.rrs = append(z.rrs, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: hash + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				Iterations: z.iterations,
+				SaltLength: uint8(len(salt) / 2),
+				Salt:       salt,
+				HashLength: 20,
+				NextDomain: sorted[(i+1)%len(sorted)],
+				TypeBitMap: bitmap,
+			})
+		}
+	} else {
+		slices.SortFunc(owners, func(a, b string) int {
+			if canonicalLess(a, b) {
+				return -1
+			}
+			return 1
+		})
+		for i, owner := range owners {
+			bitmap := append(slices.Clone(types[owner]), dns.TypeRRSIG, dns.TypeNSEC)
+			slices.Sort(bitmap)
+			z.rrs = append(z.rrs, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: owners[(i+1)%len(owners)],
+				TypeBitMap: bitmap,
+			})
+		}
+	}
+
+	now := time.Now()
+	for _, set := range rrsets(z.rrs) {
+		h := set.rrs[0].Header()
+		if h.Rrtype == dns.TypeNS && dns.CanonicalName(h.Name) != z.name {
+			continue
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: h.Ttl},
+			Algorithm:  z.key.Algorithm,
+			KeyTag:     z.key.KeyTag(),
+			SignerName: z.name,
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(z.signer, set.rrs); err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, sig)
+	}
+}
+
+// tamper changes the address of an A record once signed.
+func (z *testZone) tamper(name string) {
+	for _, rr := range z.rrs {
+		if a, ok := rr.(*dns.A); ok && a.Hdr.Name == name {
+			a.A = net.IPv4(192, 0, 2, 66)
+		}
+	}
+}
+
+// testUpstream answers like a recursive server: from the deepest zone
+// holding the name (the parent zone for DS queries), with the signatures.
+// Negative answers carry the whole NSEC/NSEC3 chain, except for the names
+// starting with "noproof".
+type testUpstream struct {
+	zones   []*testZone
+	queries atomic.Int32
+}
+
+func (u *testUpstream) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	u.queries.Add(1)
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	var zone *testZone
+	for _, z := range u.zones {
+		if dns.IsSubDomain(z.name, name) && (q.Qtype != dns.TypeDS || name != z.name) &&
+			(zone == nil || dns.CountLabel(z.name) > dns.CountLabel(zone.name)) {
+			zone = z
+		}
+	}
+	if zone == nil {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	exists := false
+	for _, rr := range zone.rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if dns.IsSubDomain(name, owner) && rr.Header().Rrtype != dns.TypeNSEC3 {
+			exists = true
+		}
+		if owner != name {
+			continue
+		}
+		if rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range zone.rrs {
+			t := rr.Header().Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				t = sig.TypeCovered
+			}
+			switch {
+			case t == dns.TypeSOA:
+			case t == dns.TypeNSEC || t == dns.TypeNSEC3:
+				if strings.HasPrefix(name, "noproof") {
+					continue
+				}
+			default:
+				continue
+			}
+			m.Ns = append(m.Ns, rr)
+		}
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+// serveTestUpstream serves a handler on UDP and TCP, on the same loopback
+// address and port, any port if 0. It returns the address.
+func serveTestUpstream(t *testing.T, handler dns.Handler, addr string) string {
+	t.Helper()
+	for range 10 {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Skipf("can't listen on %s: %s", addr, err)
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			if !strings.HasSuffix(addr, ":0") {
+				t.Skipf("can't listen on %s: %s", addr, err)
+			}
+			continue // port taken over TCP, try another one
+		}
+		for _, srv := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+			go srv.ActivateAndServe()
+			t.Cleanup(func() { srv.Shutdown() })
+		}
+		return pc.LocalAddr().String()
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// newTestForwarder returns a forwarder whose default server is addr.
+func newTestForwarder(t *testing.T, addr string) *Forwarder {
+	t.Helper()
+	log.SetLevel(log.WarnLevel)
+	filename := filepath.Join(t.TempDir(), "forward.yaml")
+	if err := os.WriteFile(filename, []byte("- servers:\n    - udp://"+addr+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newForwarder(filename, configMode{})
+}
+
+// newTestHierarchy returns a forwarder validating against a signed
+// hierarchy:
+//
+//	.                  NSEC, trust anchor
+//	test.              NSEC, bogus.test. has a wrong signature
+//	insecure.test.     unsigned delegation
+//	nsec3.test.        NSEC3
+//	costly.test.       NSEC3 with too many iterations
+func newTestHierarchy(t *testing.T) (*Forwarder, *testUpstream) {
+	t.Helper()
+	root := newTestZone(t, ".", true)
+	test := newTestZone(t, "test.", true,
+		"www.test. 300 IN A 192.0.2.1",
+		"bogus.test. 300 IN A 192.0.2.2",
+		"alias.test. 300 IN CNAME www.test.")
+	insecure := newTestZone(t, "insecure.test.", false, "www.insecure.test. 300 IN A 192.0.2.3")
+	nsec3 := newTestZone(t, "nsec3.test.", true, "www.nsec3.test. 300 IN A 192.0.2.4")
+	nsec3.nsec3 = true
+	costly := newTestZone(t, "costly.test.", true, "www.costly.test. 300 IN A 192.0.2.5")
+	costly.nsec3, costly.iterations = true, maxNSEC3Iterations+1
+
+	root.delegate(t, test)
+	for _, child := range []*testZone{insecure, nsec3, costly} {
+		test.delegate(t, child)
+	}
+	for _, z := range []*testZone{root, test, nsec3, costly} {
+		z.sign(t)
+	}
+	test.tamper("bogus.test.")
+
+	u := &testUpstream{zones: []*testZone{root, test, insecure, nsec3, costly}}
+	fw := newTestForwarder(t, serveTestUpstream(t, u, "127.0.0.1:0"))
+	anchors := &TrustAnchors{anchors: []*trustAnchor{{Record: root.key.String(), State: anchorValid, rr: root.key}}}
+	fw.validator = newValidator(fw, anchors)
+	return fw, u
+}
+
+func validatedQuery(fw *Forwarder, name string, qtype uint16) (*dns.Msg, string) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.SetEdns0(ednsUDPSize, true)
+	return fw.forward(fw.defaultZone, r)
+}
+
+// =============================================================================
+// Validation
+// =============================================================================
+
+func TestValidate(t *testing.T) {
+	fw, _ := newTestHierarchy(t)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		secure  bool
+		answers int
+	}{
+		// bogus: missing proofs, before the NSEC records are cached
+		{"noproof.test.", dns.TypeA, dns.RcodeServerFailure, false, 0},
+		{"noproof.nsec3.test.", dns.TypeA, dns.RcodeServerFailure, false, 0},
+		// secure answers, NSEC denials
+		{"www.test.", dns.TypeA, dns.RcodeSuccess, true, 2},
+		{"alias.test.", dns.TypeCNAME, dns.RcodeSuccess, true, 2},
+		{"nx.test.", dns.TypeA, dns.RcodeNameError, true, 0},
+		{"www.test.", dns.TypeAAAA, dns.RcodeSuccess, true, 0},
+		// bogus: wrong signature
+		{"bogus.test.", dns.TypeA, dns.RcodeServerFailure, false, 0},
+		// insecure: unsigned delegation
+		{"www.insecure.test.", dns.TypeA, dns.RcodeSuccess, false, 1},
+		{"nx.insecure.test.", dns.TypeA, dns.RcodeNameError, false, 0},
+		// NSEC3 denials
+		{"www.nsec3.test.", dns.TypeA, dns.RcodeSuccess, true, 2},
+		{"nx.nsec3.test.", dns.TypeA, dns.RcodeNameError, true, 0},
+		{"www.nsec3.test.", dns.TypeAAAA, dns.RcodeSuccess, true, 0},
+		// NSEC3 with too many iterations: signed answers stay secure, the
+		// proofs are insecure
+		{"www.costly.test.", dns.TypeA, dns.RcodeSuccess, true, 2},
+		{"nx.costly.test.", dns.TypeA, dns.RcodeNameError, false, 0},
+		{"www.costly.test.", dns.TypeAAAA, dns.RcodeSuccess, false, 0},
+	}
+	for _, tt := range tests {
+		resp, _ := validatedQuery(fw, tt.name, tt.qtype)
+		if resp == nil {
+			t.Errorf("%s %s: no answer", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		if resp.Rcode != tt.rcode || resp.AuthenticatedData != tt.secure || len(resp.Answer) != tt.answers {
+			t.Errorf("%s %s: got %s ad=%t %d answers, want %s ad=%t %d answers",
+				tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[resp.Rcode], resp.AuthenticatedData, len(resp.Answer),
+				dns.RcodeToString[tt.rcode], tt.secure, tt.answers)
+		}
+	}
+}
+
+// Names proven not to exist by cached NSEC/NSEC3 records are answered
+// without asking upstream (RFC 8198).
+func TestSynthesize(t *testing.T) {
+	fw, u := newTestHierarchy(t)
+	for _, name := range []string{"nx.test.", "nx.nsec3.test.", "nx.costly.test."} {
+		if resp, _ := validatedQuery(fw, name, dns.TypeA); resp == nil {
+			t.Fatalf("%s: no answer", name)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		rcode       int
+		synthesized bool
+	}{
+		{"other.test.", dns.TypeA, dns.RcodeNameError, true},
+		{"www.test.", dns.TypeTXT, dns.RcodeSuccess, true},
+		{"other.nsec3.test.", dns.TypeA, dns.RcodeNameError, true},
+		{"www.nsec3.test.", dns.TypeTXT, dns.RcodeSuccess, true},
+		{"www.test.", dns.TypeA, dns.RcodeSuccess, false},
+		{"other.costly.test.", dns.TypeA, dns.RcodeNameError, false}, // never cached
+	}
+	for _, tt := range tests {
+		before := u.queries.Load()
+		resp, source := validatedQuery(fw, tt.name, tt.qtype)
+		if resp == nil {
+			t.Errorf("%s %s: no answer", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		asked := u.queries.Load() != before
+		if resp.Rcode != tt.rcode || (source == sourceNSEC) != tt.synthesized || asked == tt.synthesized {
+			t.Errorf("%s %s: got %s from %q (upstream asked: %t), want %s synthesized=%t",
+				tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[resp.Rcode], source, asked,
+				dns.RcodeToString[tt.rcode], tt.synthesized)
+		}
+	}
+}
+
+// largeDenialZone returns a validator holding the NSEC or NSEC3 chain of a
+// zone of size names, as a validated answer would have left it.
+func largeDenialZone(size int, nsec3 bool) *Validator {
+	v := newValidator(nil, nil)
+	signed := func(rr dns.RR) *rrset {
+		return &rrset{rrs: []dns.RR{rr}, sigs: []*dns.RRSIG{{SignerName: "example."}}}
+	}
+	soa, _ := dns.NewRR("example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")
+	sets := []*rrset{signed(soa)}
+	owners := []string{"example."}
+	for i := range size {
+		owners = append(owners, fmt.Sprintf("host%05d.example.", i))
+	}
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 300}
+	}
+	if nsec3 {
+		var hashes []string
+		for _, owner := range owners {
+			hashes = append(hashes, dns.HashName(owner, dns.SHA1, maxNSEC3Iterations, "aabb"))
+		}
+		slices.Sort(hashes)
+		for i, hash := range hashes {
+			sets = append(sets, signed(&dns.NSEC3{
+				Hdr: hdr(hash+".example.", dns.TypeNSEC3), Hash: dns.SHA1, Iterations: maxNSEC3Iterations,
+				SaltLength: 2, Salt: "aabb", HashLength: 20, NextDomain: hashes[(i+1)%len(hashes)],
+				TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG},
+			}))
+		}
+	} else {
+		for i, owner := range owners {
+			sets = append(sets, signed(&dns.NSEC{
+				Hdr: hdr(owner, dns.TypeNSEC), NextDomain: owners[(i+1)%len(owners)],
+				TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+			}))
+		}
+	}
+	v.storeDenials(sets)
+	return v
+}
+
+// BenchmarkSynthesize answers random names of a large zone from its cached
+// NSEC/NSEC3 chain, the traffic of a random subdomain attack.
+func BenchmarkSynthesize(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	for _, nsec3 := range []bool{false, true} {
+		v := largeDenialZone(maxDenialRecords-1, nsec3)
+		name := map[bool]string{false: "NSEC", true: "NSEC3"}[nsec3]
+		b.Run(name, func(b *testing.B) {
+			r := new(dns.Msg)
+			r.SetEdns0(ednsUDPSize, true)
+			i := 0
+			for b.Loop() {
+				r.SetQuestion(fmt.Sprintf("host%05dx.example.", i%(maxDenialRecords-1)), dns.TypeA)
+				if resp := v.synthesize(r); resp == nil || resp.Rcode != dns.RcodeNameError {
+					b.Fatalf("%s: not synthesized", r.Question[0].Name)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// RFC 4034 6.1
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	for i := range ordered {
+		for j := range ordered {
+			if got := canonicalLess(ordered[i], ordered[j]); got != (i < j) {
+				t.Errorf("canonicalLess(%s, %s) = %t", ordered[i], ordered[j], got)
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// dnstap
+// =============================================================================
+
+// dnstap message types
+const (
+	tapClientQuery       = 5
+	tapClientResponse    = 6
+	tapForwarderQuery    = 7
+	tapForwarderResponse = 8
+)
+
+// dnstap socket protocols
+const (
+	tapUDP = 1
+	tapTCP = 2
+	tapDoT = 3
+)
+
+// Frame Streams control frames
+const (
+	fstrmAccept = 1
+	fstrmStart  = 2
+	fstrmStop   = 3
+	fstrmReady  = 4
+	fstrmFinish = 5
+
+	fstrmContentType  = 1 // control field
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+)
+
+// Dnstap sends a copy of the DNS messages, encoded as dnstap protobuf, in a
+// Frame Streams to a collector listening on a Unix socket, or to a file.
+// Messages are sent by a goroutine: when the collector is away or too slow,
+// they are dropped.
+type Dnstap struct {
+	identity []byte
+	version  []byte
+	frames   chan []byte
+	dropped  int
+	mu       sync.Mutex    // protects dropped
+	stop     chan struct{} // closed to end the stream
+	done     chan struct{} // closed once the stream is ended
+}
+
+// tap is nil unless -dnstap is set.
+var tap *Dnstap
+
+// newDnstap starts the output to "unix:/path/to/socket" or to a file.
+func newDnstap(sink, identity string) (*Dnstap, error) {
+	dt := &Dnstap{
+		identity: []byte(identity),
+		version:  []byte("owns"),
+		frames:   make(chan []byte, dnstapBuffer),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if path, ok := strings.CutPrefix(sink, "unix:"); ok {
+		go dt.runSocket(path)
+	} else {
+		file, err := os.OpenFile(sink, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeControl(file, fstrmStart); err != nil {
+			return nil, err
+		}
+		go dt.runFile(sink, file)
+	}
+	log.Infof("dnstap to %s", sink)
+	return dt, nil
+}
+
+// close ends the stream once the queued messages are written: STOP for a
+// file, STOP then FINISH from the collector for a socket.
+func (dt *Dnstap) close() {
+	if dt == nil {
+		return
+	}
+	close(dt.stop)
+	select {
+	case <-dt.done:
+	case <-time.After(dnstapRetryInterval):
+		log.Warning("dnstap: output not closed in time")
+	}
+}
+
+// runFile writes the frames to a file. Once a write fails, the messages are
+// dropped.
+func (dt *Dnstap) runFile(sink string, file *os.File) {
+	defer close(dt.done)
+	err := dt.run(file)
+	if err == nil {
+		err = writeControl(file, fstrmStop)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Errorf("dnstap: %s: %s, messages not written anymore", sink, err)
+	}
+}
+
+// runSocket connects to the collector, and connects again when it goes
+// away. Frames are dropped while disconnected.
+func (dt *Dnstap) runSocket(path string) {
+	defer close(dt.done)
+	for {
+		conn, err := net.DialTimeout("unix", path, dnstapRetryInterval)
+		if err == nil {
+			err = handshake(conn)
+			if err == nil {
+				log.Infof("dnstap: connected to %s", path)
+				if err = dt.run(conn); err == nil {
+					if err = finish(conn); err != nil {
+						log.Warningf("dnstap: %s: %s", path, err)
+					}
+					conn.Close()
+					return
+				}
+			}
+			conn.Close()
+		}
+		log.Warningf("dnstap: %s: %s", path, err)
+
+		// drop what comes while waiting to reconnect
+		timer := time.NewTimer(dnstapRetryInterval)
+	wait:
+		for {
+			select {
+			case <-dt.frames:
+				dt.drop()
+			case <-dt.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+}
+
+// handshake opens a bidirectional Frame Streams session: READY, ACCEPT,
+// then START.
+func handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(dnstapRetryInterval))
+	defer conn.SetDeadline(time.Time{})
+	if err := writeControl(conn, fstrmReady); err != nil {
+		return err
+	}
+	ctype, err := readControl(conn)
+	if err != nil {
+		return err
+	}
+	if ctype != fstrmAccept {
+		return errors.New("collector refused the session")
+	}
+	return writeControl(conn, fstrmStart)
+}
+
+// finish closes a bidirectional Frame Streams session: STOP, then FINISH.
+func finish(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(dnstapRetryInterval))
+	if err := writeControl(conn, fstrmStop); err != nil {
+		return err
+	}
+	ctype, err := readControl(conn)
+	if err != nil {
+		return err
+	}
+	if ctype != fstrmFinish {
+		return errors.New("collector didn't finish the session")
+	}
+	return nil
+}
+
+// run writes the frames until an error, or until the stream is ended, the
+// queued frames written.
+func (dt *Dnstap) run(w io.Writer) error {
+	for {
+		var frame []byte
+		select {
+		case frame = <-dt.frames:
+		case <-dt.stop:
+			select {
+			case frame = <-dt.frames:
+			default:
+				return nil
+			}
+		}
+		dt.mu.Lock()
+		dropped := dt.dropped
+		dt.dropped = 0
+		dt.mu.Unlock()
+		if dropped > 0 {
+			log.Warningf("dnstap: %d messages dropped", dropped)
+		}
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (dt *Dnstap) drop() {
+	dt.mu.Lock()
+	dt.dropped++
+	dt.mu.Unlock()
+}
+
+// send queues a message for the collector.
+func (dt *Dnstap) send(msgType uint64, m *dns.Msg, at time.Time, protocol uint64, client, server net.Addr) {
+	wire, err := m.Pack()
+	if err != nil {
+		return
+	}
+
+	var msg protobuf
+	msg.varint(1, msgType)
+	if addr, port := addrPort(client); addr != nil {
+		msg.varint(2, family(addr))
+		msg.bytes(4, addr)
+		msg.varint(6, port)
+	}
+	if addr, port := addrPort(server); addr != nil {
+		if client == nil {
+			msg.varint(2, family(addr))
+		}
+		msg.bytes(5, addr)
+		msg.varint(7, port)
+	}
+	msg.varint(3, protocol)
+	if msgType == tapClientQuery || msgType == tapForwarderQuery {
+		msg.varint(8, uint64(at.Unix()))
+		msg.fixed32(9, uint32(at.Nanosecond()))
+		msg.bytes(10, wire)
+	} else {
+		msg.varint(12, uint64(at.Unix()))
+		msg.fixed32(13, uint32(at.Nanosecond()))
+		msg.bytes(14, wire)
+	}
+
+	var frame protobuf
+	frame.bytes(1, dt.identity)
+	frame.bytes(2, dt.version)
+	frame.bytes(14, msg)
+	frame.varint(15, 1) // MESSAGE
+
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	select {
+	case dt.frames <- append(data, frame...):
+	default:
+		dt.drop()
+	}
+}
+
+// clientQuery and clientResponse tap the messages of a client.
+func (dt *Dnstap) clientQuery(w dns.ResponseWriter, r *dns.Msg, at time.Time) {
+	if dt == nil {
+		return
+	}
+	dt.send(tapClientQuery, r, at, clientProtocol(w), w.RemoteAddr(), w.LocalAddr())
+}
+
+func (dt *Dnstap) clientResponse(w dns.ResponseWriter, m *dns.Msg) {
+	if dt == nil || m == nil {
+		return
+	}
+	dt.send(tapClientResponse, m, time.Now(), clientProtocol(w), w.RemoteAddr(), w.LocalAddr())
+}
+
+// forwarderQuery and forwarderResponse tap the messages exchanged with an
+// upstream server.
+func (dt *Dnstap) forwarderQuery(serv Server, m *dns.Msg, at time.Time) {
+	if dt == nil {
+		return
+	}
+	dt.send(tapForwarderQuery, m, at, serverProtocol(serv), nil, serverAddr(serv))
+}
+
+func (dt *Dnstap) forwarderResponse(serv Server, m *dns.Msg) {
+	if dt == nil || m == nil {
+		return
+	}
+	dt.send(tapForwarderResponse, m, time.Now(), serverProtocol(serv), nil, serverAddr(serv))
+}
+
+func clientProtocol(w dns.ResponseWriter) uint64 {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return tapTCP
+	}
+	return tapUDP
+}
+
+func serverProtocol(serv Server) uint64 {
+	switch serv.Scheme {
+	case "tcp":
+		return tapTCP
+	case "tcp-tls":
+		return tapDoT
+	}
+	return tapUDP
+}
+
+// serverAddr returns the address of a server, nil when given by name.
+func serverAddr(serv Server) net.Addr {
+	ip := net.ParseIP(serv.Addr)
+	if ip == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: serv.Port}
+}
+
+func addrPort(addr net.Addr) (net.IP, uint64) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return compactIP(addr.IP), uint64(addr.Port)
+	case *net.TCPAddr:
+		return compactIP(addr.IP), uint64(addr.Port)
+	}
+	return nil, 0
+}
+
+// compactIP returns IPv4 addresses on 4 bytes, as dnstap expects.
+func compactIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func family(ip net.IP) uint64 {
+	if len(ip) == net.IPv4len {
+		return 1 // INET
+	}
+	return 2 // INET6
+}
+
+// =============================================================================
+// Frame Streams & protobuf encoding
+// =============================================================================
+
+// writeControl writes a control frame, with the dnstap content type for
+// READY, ACCEPT and START.
+func writeControl(w io.Writer, ctype uint32) error {
+	payload := binary.BigEndian.AppendUint32(nil, ctype)
+	if ctype != fstrmStop && ctype != fstrmFinish {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0) // escape: control frame
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readControl reads a control frame and returns its type.
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:4]) != 0 || n < 4 || n > 512 {
+		return 0, errors.New("bad control frame")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// protobuf is a message being encoded, field by field.
+type protobuf []byte
+
+func (p *protobuf) tag(field, wireType uint64) {
+	*p = binary.AppendUvarint(*p, field<<3|wireType)
+}
+
+func (p *protobuf) varint(field, v uint64) {
+	p.tag(field, 0)
+	*p = binary.AppendUvarint(*p, v)
+}
+
+func (p *protobuf) fixed32(field uint64, v uint32) {
+	p.tag(field, 5)
+	*p = binary.LittleEndian.AppendUint32(*p, v)
+}
+
+func (p *protobuf) bytes(field uint64, b []byte) {
+	p.tag(field, 2)
+	*p = binary.AppendUvarint(*p, uint64(len(b)))
+	*p = append(*p, b...)
+}
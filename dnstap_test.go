@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProtobuf(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  func(p *protobuf)
+		want []byte
+	}{
+		{"varint", func(p *protobuf) { p.varint(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{"zero varint", func(p *protobuf) { p.varint(3, 0) }, []byte{0x18, 0x00}},
+		{"large field", func(p *protobuf) { p.varint(16, 1) }, []byte{0x80, 0x01, 0x01}},
+		{"fixed32", func(p *protobuf) { p.fixed32(9, 0x01020304) }, []byte{0x4d, 0x04, 0x03, 0x02, 0x01}},
+		{"bytes", func(p *protobuf) { p.bytes(2, []byte("owns")) }, []byte{0x12, 0x04, 'o', 'w', 'n', 's'}},
+		{"empty bytes", func(p *protobuf) { p.bytes(14, nil) }, []byte{0x72, 0x00}},
+		{"fields in order", func(p *protobuf) { p.varint(1, 5); p.bytes(4, []byte{127, 0, 0, 1}) },
+			[]byte{0x08, 0x05, 0x22, 0x04, 127, 0, 0, 1}},
+	}
+	for _, tt := range tests {
+		var p protobuf
+		tt.enc(&p)
+		if !bytes.Equal(p, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, []byte(p), tt.want)
+		}
+	}
+}
+
+// decodeProtobuf decodes the fields of a message, keeping the last value of
+// each: uint64 for varint and fixed32, []byte for bytes.
+func decodeProtobuf(t *testing.T, b []byte) map[uint64]any {
+	t.Helper()
+	fields := map[uint64]any{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[tag>>3], b = v, b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fields[tag>>3], b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			fields[tag>>3], b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			t.Fatalf("wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+func TestDnstapMessage(t *testing.T) {
+	at := time.Unix(1700000000, 42)
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5300}
+	serv, _ := parseServer("tls://[2001:db8::1]")
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	wire, _ := m.Pack()
+
+	tests := []struct {
+		name   string
+		send   func(dt *Dnstap)
+		fields map[uint64]any
+	}{
+		{"client query", func(dt *Dnstap) { dt.send(tapClientQuery, m, at, tapUDP, client, nil) },
+			map[uint64]any{1: uint64(tapClientQuery), 2: uint64(1), 3: uint64(tapUDP),
+				4: []byte{192, 0, 2, 1}, 6: uint64(5300), 8: uint64(1700000000), 9: uint64(42), 10: wire}},
+		{"forwarder response", func(dt *Dnstap) { dt.forwarderResponse(serv, m) },
+			map[uint64]any{1: uint64(tapForwarderResponse), 2: uint64(2), 3: uint64(tapDoT),
+				5: []byte(net.ParseIP("2001:db8::1")), 7: uint64(853), 14: wire}},
+	}
+	for _, tt := range tests {
+		dt := &Dnstap{identity: []byte("host"), version: []byte("owns"), frames: make(chan []byte, 1)}
+		tt.send(dt)
+		frame := <-dt.frames
+		if n := binary.BigEndian.Uint32(frame); int(n) != len(frame)-4 {
+			t.Errorf("%s: frame length %d, want %d", tt.name, n, len(frame)-4)
+			continue
+		}
+		outer := decodeProtobuf(t, frame[4:])
+		if string(outer[1].([]byte)) != "host" || string(outer[2].([]byte)) != "owns" || outer[15] != uint64(1) {
+			t.Errorf("%s: wrong envelope %v", tt.name, outer)
+		}
+		msg := decodeProtobuf(t, outer[14].([]byte))
+		for field, want := range tt.fields {
+			got := msg[field]
+			if b, ok := want.([]byte); ok {
+				if g, _ := got.([]byte); !bytes.Equal(g, b) {
+					t.Errorf("%s: field %d: got %v, want %v", tt.name, field, got, want)
+				}
+			} else if got != want {
+				t.Errorf("%s: field %d: got %v, want %v", tt.name, field, got, want)
+			}
+		}
+	}
+}
+
+// A truncated UDP answer retried over TCP is tapped, and the TCP exchange
+// is tapped as such.
+func TestDnstapTCPRetry(t *testing.T) {
+	addr := serveTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	}), "127.0.0.1:0")
+	fw := newTestForwarder(t, addr)
+	dt := &Dnstap{frames: make(chan []byte, 16)}
+	tap = dt
+	t.Cleanup(func() { tap = nil })
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	if resp, _ := fw.resolve(fw.defaultZone, r); resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("answer %v, want the TCP one", resp)
+	}
+	tap = nil
+
+	want := []struct {
+		msgType   uint64
+		protocol  uint64
+		truncated bool
+	}{
+		{tapForwarderQuery, tapUDP, false},
+		{tapForwarderResponse, tapUDP, true},
+		{tapForwarderQuery, tapTCP, false},
+		{tapForwarderResponse, tapTCP, false},
+	}
+	for i, w := range want {
+		var frame []byte
+		select {
+		case frame = <-dt.frames:
+		default:
+			t.Fatalf("%d messages tapped, want %d", i, len(want))
+		}
+		msg := decodeProtobuf(t, decodeProtobuf(t, frame[4:])[14].([]byte))
+		if msg[1] != w.msgType || msg[3] != w.protocol {
+			t.Errorf("message %d: type %v over %v, want %d over %d", i, msg[1], msg[3], w.msgType, w.protocol)
+		}
+		if w.msgType == tapForwarderResponse {
+			m := new(dns.Msg)
+			if err := m.Unpack(msg[14].([]byte)); err != nil || m.Truncated != w.truncated {
+				t.Errorf("message %d: truncated %t (%v), want %t", i, m.Truncated, err, w.truncated)
+			}
+		}
+	}
+	if len(dt.frames) != 0 {
+		t.Errorf("%d more messages tapped", len(dt.frames))
+	}
+}
+
+// readFrame reads a frame, returning the control type of control frames, or
+// the data of data frames.
+func readFrame(t *testing.T, r io.Reader) (uint32, []byte) {
+	t.Helper()
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(length[:]); n > 0 {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return 0, data
+	}
+	ctype, err := readControl(io.MultiReader(bytes.NewReader(length[:]), r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctype, nil
+}
+
+// A file stream starts with START and ends with STOP.
+func TestDnstapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owns.tap")
+	dt, err := newDnstap(path, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	for range 3 {
+		dt.send(tapClientQuery, m, time.Now(), tapUDP, nil, nil)
+	}
+	dt.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+	if ctype, _ := readFrame(t, r); ctype != fstrmStart {
+		t.Fatalf("first frame %d, want START", ctype)
+	}
+	for i := range 3 {
+		if _, frame := readFrame(t, r); frame == nil {
+			t.Fatalf("frame %d is a control frame", i)
+		}
+	}
+	if ctype, _ := readFrame(t, r); ctype != fstrmStop {
+		t.Fatalf("last frame %d, want STOP", ctype)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes after STOP", r.Len())
+	}
+}
+
+// A socket stream is opened by READY, ACCEPT, START, and closed by STOP,
+// FINISH.
+func TestDnstapSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owns.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	dt, err := newDnstap("unix:"+path, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if ctype, _ := readFrame(t, conn); ctype != fstrmReady {
+		t.Fatalf("got %d, want READY", ctype)
+	}
+	writeControl(conn, fstrmAccept)
+	if ctype, _ := readFrame(t, conn); ctype != fstrmStart {
+		t.Fatalf("got %d, want START", ctype)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	dt.send(tapClientQuery, m, time.Now(), tapUDP, nil, nil)
+	if _, frame := readFrame(t, conn); frame == nil {
+		t.Fatal("no data frame")
+	}
+	closed := make(chan struct{})
+	go func() {
+		dt.close()
+		close(closed)
+	}()
+	if ctype, _ := readFrame(t, conn); ctype != fstrmStop {
+		t.Fatalf("got %d, want STOP", ctype)
+	}
+	writeControl(conn, fstrmFinish)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed after FINISH")
+	}
+}
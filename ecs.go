@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// =============================================================================
+// EDNS Client Subnet (RFC 7871)
+// =============================================================================
+
+const (
+	ecsStrip = "strip" // remove the client subnet (default)
+	ecsPass  = "pass"  // forward the client subnet as sent by the client
+	ecsAdd   = "add"   // send the subnet of the client address
+)
+
+// ecsPolicy tells what a zone does with the client subnet of the queries.
+type ecsPolicy struct {
+	mode    string
+	prefix4 int // source prefix length of the added IPv4 subnets
+	prefix6 int // source prefix length of the added IPv6 subnets
+}
+
+var defaultECSPolicy = ecsPolicy{mode: ecsStrip, prefix4: defaultECSPrefix4, prefix6: defaultECSPrefix6}
+
+func parseECSPolicy(config ForwardConfig) (ecsPolicy, error) {
+	policy := defaultECSPolicy
+	switch config.ECS {
+	case "":
+	case ecsStrip, ecsPass, ecsAdd:
+		policy.mode = config.ECS
+	default:
+		return defaultECSPolicy, fmt.Errorf("UNKNOWN ECS MODE: %s", config.ECS)
+	}
+	if config.ECSPrefix4 < 0 || config.ECSPrefix4 > 32 || config.ECSPrefix6 < 0 || config.ECSPrefix6 > 128 {
+		return defaultECSPolicy, fmt.Errorf("ECS PREFIX ERROR: %d/%d", config.ECSPrefix4, config.ECSPrefix6)
+	}
+	if config.ECSPrefix4 != 0 {
+		policy.prefix4 = config.ECSPrefix4
+	}
+	if config.ECSPrefix6 != 0 {
+		policy.prefix6 = config.ECSPrefix6
+	}
+	return policy, nil
+}
+
+// findECS returns the client subnet option of a message, if any.
+func findECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// removeECS removes the client subnet option of a message.
+func removeECS(m *dns.Msg) {
+	removeOptions(m, dns.EDNS0SUBNET)
+}
+
+// ecsKey identifies the subnet of a request in the cache key: the address
+// truncated to the source prefix length.
+func ecsKey(ecs *dns.EDNS0_SUBNET) string {
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+	mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+	return fmt.Sprintf("%s/%d", ecs.Address.Mask(mask), ecs.SourceNetmask)
+}
+
+// applyECS rewrites the client subnet of a request according to the policy
+// of its zone. When the request is changed, the returned writer restores
+// what the client expects in the response.
+func (fw *Forwarder) applyECS(w dns.ResponseWriter, r *dns.Msg) (dns.ResponseWriter, *dns.Msg) {
+	policy := fw.route(r).ECS
+	clientECS := findECS(r)
+
+	switch {
+	case clientECS == nil && policy.mode != ecsAdd:
+		return w, r
+	case policy.mode == ecsPass,
+		policy.mode == ecsAdd && clientECS != nil && clientECS.SourceNetmask == 0: // the client asked for privacy
+		// unchanged, but a cached response may carry the subnet of another client
+		return &ecsWriter{ResponseWriter: w, client: r}, r
+	}
+
+	query := r.Copy()
+	removeECS(query)
+	if policy.mode == ecsAdd {
+		if ecs := clientSubnet(w.RemoteAddr(), policy); ecs != nil {
+			if query.IsEdns0() == nil {
+				query.SetEdns0(dns.MinMsgSize, false)
+			}
+			opt := query.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+	}
+	return &ecsWriter{ResponseWriter: w, client: r}, query
+}
+
+// clientSubnet returns the subnet option for a client address.
+func clientSubnet(addr net.Addr, policy ecsPolicy) *dns.EDNS0_SUBNET {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return nil
+	}
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = uint8(policy.prefix4)
+		ecs.Address = ip4.Mask(net.CIDRMask(policy.prefix4, 32))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = uint8(policy.prefix6)
+		ecs.Address = ip.Mask(net.CIDRMask(policy.prefix6, 128))
+	}
+	return ecs
+}
+
+// ecsWriter answers a client whose request had its subnet rewritten: the
+// response carries the subnet the client sent (none if it sent none), and
+// fits the buffer size it asked for.
+type ecsWriter struct {
+	dns.ResponseWriter
+	client *dns.Msg // the request as sent by the client
+}
+
+func (w *ecsWriter) WriteMsg(m *dns.Msg) error {
+	if opt := m.IsEdns0(); opt != nil {
+		clientECS := findECS(w.client)
+		switch {
+		case w.client.IsEdns0() == nil:
+			m.Extra = removeType(m.Extra, dns.TypeOPT, 0)
+		case clientECS == nil:
+			removeECS(m)
+		default:
+			if ecs := findECS(m); ecs != nil {
+				scope := ecs.SourceScope
+				*ecs = *clientECS
+				ecs.SourceScope = scope
+			}
+		}
+	}
+	truncateToFit(m, w.client)
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ecsUpstream answers the A queries with an address telling the subnet it
+// got: 192.0.2.1 for none, 192.0.2.<third byte> for IPv4 subnets, and
+// 192.0.2.6 for IPv6 ones. The subnet is echoed with the scope of the
+// source prefix, 0 for the names starting with "global".
+type ecsUpstream struct {
+	queries atomic.Int32
+	mu      sync.Mutex
+	subnet  string // subnet of the last query
+}
+
+func (u *ecsUpstream) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	u.queries.Add(1)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	ip := "192.0.2.1"
+	subnet := ""
+	if ecs := findECS(r); ecs != nil {
+		subnet = ecsKey(ecs)
+		switch {
+		case ecs.Family == 2:
+			ip = "192.0.2.6"
+		case ecs.Address.To4() != nil:
+			ip = fmt.Sprintf("192.0.2.%d", ecs.Address.To4()[2])
+		}
+		reply := *ecs
+		reply.SourceScope = ecs.SourceNetmask
+		if dns.SplitDomainName(r.Question[0].Name)[0] == "global" {
+			reply.SourceScope = 0
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &reply)
+	}
+	u.mu.Lock()
+	u.subnet = subnet
+	u.mu.Unlock()
+	rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + ip)
+	m.Answer = append(m.Answer, rr)
+	w.WriteMsg(m)
+}
+
+func (u *ecsUpstream) lastSubnet() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.subnet
+}
+
+// newECSForwarder returns a forwarder whose default zone, served by u, has
+// the given client subnet mode.
+func newECSForwarder(t *testing.T, u *ecsUpstream, mode string) *Forwarder {
+	t.Helper()
+	log.SetLevel(log.WarnLevel)
+	addr := serveTestUpstream(t, u, "127.0.0.1:0")
+	config := "- servers:\n    - udp://" + addr + "\n"
+	if mode != "" {
+		config += "  ecs: " + mode + "\n"
+	}
+	filename := filepath.Join(t.TempDir(), "forward.yaml")
+	if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newForwarder(filename, configMode{})
+}
+
+// testWriter keeps the response written to a client.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// ecsQuery asks for the A record of name from the client address, with the
+// subnet option if any (address/prefix), the way answer does. It returns
+// the response written to the client.
+func ecsQuery(t *testing.T, fw *Forwarder, client, name, subnet string) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.SetEdns0(ednsUDPSize, false)
+	if subnet != "" {
+		ip, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, Address: ip}
+		if ip.To4() == nil {
+			ecs.Family = 2
+		}
+		ones, _ := ipnet.Mask.Size()
+		ecs.SourceNetmask = uint8(ones)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, ecs)
+	}
+	tw := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+	w, query := fw.applyECS(tw, r)
+	if !fw.handleCache(w, query) {
+		fw.handleRequest(name, w, query)
+	}
+	if tw.msg == nil {
+		t.Fatalf("%s from %s (%s): no answer", name, client, subnet)
+	}
+	return tw.msg
+}
+
+func answerIP(m *dns.Msg) string {
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return ""
+}
+
+func TestECSPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		client   string
+		subnet   string // sent by the client
+		upstream string // received upstream
+	}{
+		{"default strips", "", "192.0.2.77", "198.51.100.0/24", ""},
+		{"strip", ecsStrip, "192.0.2.77", "198.51.100.0/24", ""},
+		{"strip without subnet", ecsStrip, "192.0.2.77", "", ""},
+		{"pass", ecsPass, "192.0.2.77", "198.51.100.0/24", "198.51.100.0/24"},
+		{"pass without subnet", ecsPass, "192.0.2.77", "", ""},
+		{"add", ecsAdd, "192.0.2.77", "", "192.0.2.0/24"},
+		{"add IPv6", ecsAdd, "2001:db8:1:2ff::1", "", "2001:db8:1:200::/56"},
+		{"add replaces", ecsAdd, "192.0.2.77", "198.51.100.0/24", "192.0.2.0/24"},
+		{"add keeps privacy", ecsAdd, "192.0.2.77", "0.0.0.0/0", "0.0.0.0/0"},
+	}
+	for _, tt := range tests {
+		u := &ecsUpstream{}
+		fw := newECSForwarder(t, u, tt.mode)
+		resp := ecsQuery(t, fw, tt.client, "www.example.", tt.subnet)
+		if got := u.lastSubnet(); got != tt.upstream {
+			t.Errorf("%s: upstream got subnet %q, want %q", tt.name, got, tt.upstream)
+		}
+		// the client gets back the subnet it sent, or none
+		ecs := findECS(resp)
+		switch {
+		case tt.subnet == "" && ecs != nil:
+			t.Errorf("%s: subnet %s in the response, none asked", tt.name, ecsKey(ecs))
+		case tt.subnet != "" && tt.upstream != "" && (ecs == nil || ecsKey(ecs) != tt.subnet):
+			t.Errorf("%s: response subnet %v, want %s", tt.name, ecs, tt.subnet)
+		}
+	}
+}
+
+// Answers for a subnet are cached for that subnet only, the ones of scope
+// 0 for every client.
+func TestECSCache(t *testing.T) {
+	for _, mode := range []string{ecsPass, ecsAdd} {
+		u := &ecsUpstream{}
+		fw := newECSForwarder(t, u, mode)
+		// two clients in distinct subnets, sent by them in pass mode,
+		// derived from their address in add mode
+		clients := []struct{ addr, subnet, ip string }{
+			{"198.51.100.7", "198.51.100.0/24", "192.0.2.100"},
+			{"203.0.113.7", "203.0.113.0/24", "192.0.2.113"},
+		}
+		query := func(client int, name string) (string, bool) {
+			c := clients[client]
+			subnet := c.subnet
+			if mode == ecsAdd {
+				subnet = ""
+			}
+			before := u.queries.Load()
+			resp := ecsQuery(t, fw, c.addr, name, subnet)
+			return answerIP(resp), u.queries.Load() != before
+		}
+
+		for round, wantAsked := range []bool{true, false} {
+			for i, c := range clients {
+				ip, asked := query(i, "www.example.")
+				if ip != c.ip || asked != wantAsked {
+					t.Errorf("%s, round %d, client %s: got %s (upstream asked: %t), want %s (%t)",
+						mode, round, c.addr, ip, asked, c.ip, wantAsked)
+				}
+			}
+		}
+
+		// scope 0: valid for any subnet, kept under the question key
+		if ip, asked := query(0, "global.example."); ip != clients[0].ip || !asked {
+			t.Errorf("%s: global.example. got %s (upstream asked: %t)", mode, ip, asked)
+		}
+		if ip, asked := query(1, "global.example."); ip != clients[0].ip || asked {
+			t.Errorf("%s: global.example. from another subnet got %s (upstream asked: %t), want the cached %s",
+				mode, ip, asked, clients[0].ip)
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("global.example.", dns.TypeA)
+		r.SetEdns0(ednsUDPSize, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option,
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")})
+		fw.cacheMu.RLock()
+		_, scoped := fw.cache[requestKey(r)]
+		_, global := fw.cache[questionKey(r)]
+		fw.cacheMu.RUnlock()
+		if scoped || !global {
+			t.Errorf("%s: scope 0 answer cached under the subnet key: %t, the question key: %t", mode, scoped, global)
+		}
+	}
+}
@@ -3,9 +3,8 @@ package main
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,136 +15,271 @@ import (
 )
 
 type ForwardConfig struct {
-	Networks []string `yaml:"networks"`
-	Servers  []string `yaml:"servers,omitempty"`
-	Domains  []string `yaml:"domains,omitempty"`
+	Name       string   `yaml:"name,omitempty"`
+	Networks   []string `yaml:"networks"`
+	Servers    []string `yaml:"servers,omitempty"`
+	Domains    []string `yaml:"domains,omitempty"`
+	Source     string   `yaml:"source,omitempty"`     // default source address of the servers
+	Interface  string   `yaml:"interface,omitempty"`  // default interface of the servers
+	Proxy      string   `yaml:"proxy,omitempty"`      // default proxy of the servers
+	NTA        bool     `yaml:"nta,omitempty"`        // negative trust anchor: no DNSSEC validation
+	Recursive  bool     `yaml:"recursive,omitempty"`  // resolve from the root servers
+	ECS        string   `yaml:"ecs,omitempty"`        // client subnet: strip, pass or add
+	ECSPrefix4 int      `yaml:"ecsPrefix4,omitempty"` // IPv4 prefix length of the added subnets
+	ECSPrefix6 int      `yaml:"ecsPrefix6,omitempty"` // IPv6 prefix length of the added subnets
 }
 
 type Forward struct {
-	Networks []*net.IPNet
-	Servers  []Server
-	Domains  []string
+	Name      string
+	Networks  []*net.IPNet
+	Servers   []Server
+	Domains   []string
+	NTA       bool
+	Recursive bool
+	ECS       ecsPolicy
 }
 
-type Server struct {
-	Scheme string
-	Addr   string
-	Port   int
+// configMode tells how forward.yaml is checked and its zones searched.
+type configMode struct {
+	strict       bool // reject forward.yaml on any problem
+	longestMatch bool // the most specific network or domain wins, not the first
 }
 
 type Forwarder struct {
+	filename       string
+	mode           configMode
 	cache          map[string]CacheEntry
 	zones          []Forward
 	defaultServers []Server
+	defaultZone    *Forward
+	routes         *routes      // nil unless -longestMatch
+	zonesMu        sync.RWMutex // protects the zones, replaced on reload
 	cacheMu        sync.RWMutex
+	saveMu         sync.Mutex // one cache snapshot written at a time
 	connPool       *ConnPool
+	inflight       map[string]*inflightCall
+	inflightMu     sync.Mutex
+	validator      *Validator // nil unless -dnssec
 }
 
 type CacheEntry struct {
 	Response *dns.Msg
 	Expiry   time.Time
+	Zone     string // name of the zone that answered
 }
 
-func newForwarder(filename string) *Forwarder {
+// inflightCall is an upstream exchange shared by every client asking the
+// same question while it is running.
+type inflightCall struct {
+	done   chan struct{}
+	resp   *dns.Msg
+	source string
+}
+
+func newForwarder(filename string, mode configMode) *Forwarder {
 	fw := new(Forwarder)
+	fw.filename = filename
+	fw.mode = mode
 	fw.cache = map[string]CacheEntry{}
+	fw.inflight = map[string]*inflightCall{}
 	fw.connPool = newConnPool()
 
-	data, err := os.ReadFile(filename)
+	zones, err := fw.loadZones()
 	if err != nil {
-		log.Fatal("Error reading file:", err)
+		log.Fatal(err)
 	}
+	fw.setZones(zones)
+	fw.warmUp()
+	go fw.cleanExpiredCacheEntries()
+	return fw
+}
 
+// readForwardConfig reads forward.yaml. In strict mode, the whole file is
+// rejected on any problem.
+func readForwardConfig(filename string, mode configMode) ([]ForwardConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file: %w", err)
+	}
+	if mode.strict {
+		problems, warnings := validateConfig(filename, data, mode.longestMatch)
+		for _, warning := range warnings {
+			log.Warning(warning)
+		}
+		for _, problem := range problems {
+			log.Error(problem)
+		}
+		if len(problems) > 0 {
+			return nil, configProblems(problems)
+		}
+	}
 	var fwConfigs []ForwardConfig
-	err = yaml.Unmarshal(data, &fwConfigs)
+	if err := yaml.Unmarshal(data, &fwConfigs); err != nil {
+		return nil, fmt.Errorf("Error decoding YAML: %w", err)
+	}
+	return fwConfigs, nil
+}
+
+// buildZones builds the zones of a configuration, the default zone, and
+// the routing table in longest match mode. They are returned in a Forwarder
+// holding nothing else, with the problems of the configuration.
+func buildZones(fwConfigs []ForwardConfig, longestMatch bool) (*Forwarder, []error) {
+	zones := new(Forwarder)
+	problems := zones.extract(fwConfigs)
+	zones.defaultServers = zones.findServersByDefault()
+	zones.defaultZone = zones.newDefaultZone()
+	if longestMatch {
+		zones.routes = newRoutes(zones.zones)
+	}
+	return zones, problems
+}
+
+// loadZones reads forward.yaml and builds its zones, without using them yet.
+func (fw *Forwarder) loadZones() (*Forwarder, error) {
+	fwConfigs, err := readForwardConfig(fw.filename, fw.mode)
 	if err != nil {
-		log.Fatal("Error decoding YAML:", err)
+		return nil, err
 	}
-	fw.extract(fwConfigs)
-	fw.defaultServers = fw.findServersByDefault()
-	go fw.cleanExpiredCacheEntries()
-	return fw
+	zones, problems := buildZones(fwConfigs, fw.mode.longestMatch)
+	for _, problem := range problems {
+		log.Warning(problem)
+	}
+	return zones, nil
+}
+
+// setZones replaces the zones by the ones of loadZones.
+func (fw *Forwarder) setZones(next *Forwarder) {
+	fw.zonesMu.Lock()
+	fw.zones = next.zones
+	fw.defaultServers = next.defaultServers
+	fw.defaultZone = next.defaultZone
+	fw.routes = next.routes
+	fw.zonesMu.Unlock()
+}
+
+// reload replaces the zones by the ones loadZones read again. The cache is
+// flushed, as its answers may come from servers no longer used.
+func (fw *Forwarder) reload(next *Forwarder) {
+	fw.setZones(next)
+	fw.connPool.clearWarm()
+	fw.warmUp()
+	fw.flushCache(matchAll)
+	fw.info()
 }
 
-func (fw *Forwarder) extract(fwConfigs []ForwardConfig) {
+// extract builds the zones of the configuration. Invalid networks and
+// servers are skipped, invalid options ignored: it returns these problems.
+func (fw *Forwarder) extract(fwConfigs []ForwardConfig) []error {
+	var problems []error
 	for _, config := range fwConfigs {
 		// parsing CIDR Networks
 		var networks []*net.IPNet
 		for _, networkStr := range config.Networks {
 			_, ipNet, err := net.ParseCIDR(networkStr)
 			if err != nil {
-				log.Warningf("Error parsing CIDR: %s\n", err)
+				problems = append(problems, fmt.Errorf("Error parsing CIDR: %w", err))
 				continue
 			}
 			networks = append(networks, ipNet)
 		}
+		// parsing zone wide Servers options
+		var source net.IP
+		if config.Source != "" {
+			var err error
+			if source, err = parseSource(config.Source); err != nil {
+				problems = append(problems, fmt.Errorf("Error parsing source %s: %w", config.Source, err))
+			}
+		}
+		iface := config.Interface
+		if iface != "" {
+			if _, err := bindControl(iface); err != nil {
+				problems = append(problems, fmt.Errorf("Error parsing interface %s: %w", iface, err))
+				iface = ""
+			}
+		}
+		var proxyURL *url.URL
+		if config.Proxy != "" {
+			var err error
+			if proxyURL, err = parseProxy(config.Proxy); err != nil {
+				problems = append(problems, fmt.Errorf("Error parsing proxy %s: %w", config.Proxy, err))
+			}
+		}
+		ecs, err := parseECSPolicy(config)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Error parsing ECS policy: %w", err))
+		}
 		// parsing Servers
 		var servers []Server
 		for _, serverStr := range config.Servers {
-			scheme, addr, port, err := extractServerURL(serverStr)
+			server, err := parseServer(serverStr)
 			if err != nil {
-				log.Warningf("Error parsing Server: %s\n", err)
+				problems = append(problems, fmt.Errorf("Error parsing Server: %w", err))
 				continue
 			}
-			servers = append(servers, Server{scheme, addr, port})
+			if server.Source == nil {
+				server.Source = source
+			}
+			if server.Interface == "" {
+				server.Interface = iface
+			}
+			if server.Proxy == nil {
+				server.Proxy = proxyURL
+			}
+			// proxies only carry TCP
+			if server.Proxy != nil && server.Scheme == "udp" {
+				log.Infof("%s: using TCP through proxy %s", server, server.Proxy.Redacted())
+				server.Scheme = "tcp"
+			}
+			servers = append(servers, server)
 		}
 
 		zone := Forward{
-			Networks: networks,
-			Domains:  config.Domains,
-			Servers:  servers,
+			Name:      zoneName(config),
+			Networks:  networks,
+			Domains:   config.Domains,
+			Servers:   servers,
+			NTA:       config.NTA,
+			Recursive: config.Recursive,
+			ECS:       ecs,
 		}
 		fw.zones = append(fw.zones, zone)
 	}
+	return problems
 }
 
-func extractServerURL(inputURL string) (string, string, int, error) {
-	re := regexp.MustCompile(`^(?P<Scheme>[a-z]+)://(?:\[(?P<IPv6>[0-9a-fA-F:]+)\]|(?P<IPv4>[^:/]+))(?::(?P<Port>\d+))?$`)
-	matches := re.FindStringSubmatch(inputURL)
-
-	if len(matches) == 0 {
-		return "", "", 0, fmt.Errorf("WRONG SERVER FORMAT: %s", inputURL)
-	}
-
-	scheme := strings.ToLower(matches[re.SubexpIndex("Scheme")])
-	ipv6 := matches[re.SubexpIndex("IPv6")]
-	ipv4 := matches[re.SubexpIndex("IPv4")]
-	port := matches[re.SubexpIndex("Port")]
-
-	addr := ipv4
-	if ipv6 != "" {
-		addr = ipv6
-	}
-
-	switch scheme {
-	case "udp", "tcp", "tls":
-	default:
-		return "", "", 0, fmt.Errorf("SERVER SCHEME ERROR: %s://", scheme)
+// zoneName returns the configured name of a zone, or derives one from its
+// first domain or network.
+func zoneName(config ForwardConfig) string {
+	switch {
+	case config.Name != "":
+		return config.Name
+	case len(config.Domains) > 0:
+		return config.Domains[0]
+	case len(config.Networks) > 0:
+		return config.Networks[0]
 	}
+	return defaultZoneName
+}
 
-	finalPort := 53
-	if port == "" {
-		if scheme == "tls" {
-			finalPort = 853
-		}
-	} else {
-		var err error
-		finalPort, err = strconv.Atoi(port)
-		if err != nil {
-			return "", "", 0, fmt.Errorf("SERVER PORT ERROR: %s", port)
+// warmUp opens the warm-up connections of the TCP/TLS servers.
+func (fw *Forwarder) warmUp() {
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
+	for _, zone := range fw.zones {
+		for _, serv := range zone.Servers {
+			if serv.Warm > 0 && strings.HasPrefix(serv.Scheme, "tcp") {
+				fw.connPool.keepWarm(serv.client(), serv)
+			}
 		}
 	}
-
-	if scheme == "tls" {
-		scheme = "tcp-tls"
-	}
-
-	return scheme, addr, finalPort, nil
 }
 
 func (fw *Forwarder) display() {
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
 	for _, zone := range fw.zones {
-		fmt.Printf("* Servers: %v\n", zone.Servers)
+		fmt.Printf("* Zone: %s\n", zone.Name)
+		fmt.Printf("  Servers: %v\n", zone.Servers)
 		fmt.Printf("  Networks:\n")
 		for _, ipNet := range zone.Networks {
 			fmt.Printf("    %s\n", ipNet.String())
@@ -156,51 +290,117 @@ func (fw *Forwarder) display() {
 }
 
 func (fw *Forwarder) info() {
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
 	log.Infof("Loaded %d zones", len(fw.zones))
 	log.Infof("Found %d default servers", len(fw.defaultServers))
+	if fw.defaultZone.Recursive {
+		log.Infof("Default zone is recursive")
+	}
 }
 
 // =============================================================================
 // Search
 // =============================================================================
 
-// search servers for a known IP address (v4 or v6)
-func (fw *Forwarder) findServersByIP(ip net.IP) []Server {
-	for _, zone := range fw.zones {
+// search the zone of a known IP address (v4 or v6): the first zone holding
+// it, or the most specific with -longestMatch
+func (fw *Forwarder) findZoneByIP(ip net.IP) *Forward {
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
+	if fw.routes != nil {
+		return fw.routes.findZoneByIP(ip)
+	}
+	for i, zone := range fw.zones {
 		for _, ipNet := range zone.Networks {
 			if ipNet.Contains(ip) {
-				return zone.Servers
+				return &fw.zones[i]
 			}
 		}
 	}
 	return nil
 }
 
-// search if it's known domain
-func (fw *Forwarder) findServersByFQDN(fqdn string) []Server {
-	for _, zone := range fw.zones {
+// search the zone of a known domain: the first zone holding it, or the
+// most specific with -longestMatch
+func (fw *Forwarder) findZoneByFQDN(fqdn string) *Forward {
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
+	if fw.routes != nil {
+		return fw.routes.findZoneByFQDN(fqdn)
+	}
+	for i, zone := range fw.zones {
 		for _, domain := range zone.Domains {
-			if domain == fqdn || strings.HasSuffix(fqdn, "."+domain) {
-				return zone.Servers
+			if inDomain(fqdn, domain) {
+				return &fw.zones[i]
 			}
 		}
 	}
 	return nil
 }
 
+// inDomain reports whether fqdn, without its final dot, is the domain or a
+// subdomain, whatever the case.
+func inDomain(fqdn, domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	n := len(fqdn) - len(domain)
+	return n >= 0 && strings.EqualFold(fqdn[n:], domain) && (n == 0 || fqdn[n-1] == '.')
+}
+
 // return the default servers
 func (fw *Forwarder) findServersByDefault() []Server {
 	var servers []Server
 	for _, zone := range fw.zones {
 		if len(zone.Networks) == 0 && len(zone.Domains) == 0 {
-			// TODO: check if this list is needed, as we should not have more than
-			// one default zone so zone.servers should be enough
+			// several default blocks are merged, -strict rejects them
 			servers = append(servers, zone.Servers...)
 		}
 	}
 	return servers
 }
 
+// build the zone of the default servers, with the options of the first
+// default block
+func (fw *Forwarder) newDefaultZone() *Forward {
+	zone := &Forward{Name: defaultZoneName, Servers: fw.defaultServers, ECS: defaultECSPolicy}
+	for _, z := range fw.zones {
+		if len(z.Networks) == 0 && len(z.Domains) == 0 {
+			zone.Recursive = z.Recursive
+			zone.ECS = z.ECS
+			break
+		}
+	}
+	return zone
+}
+
+// route returns the zone answering a request, as handleRRequest and
+// handleRequest choose it.
+func (fw *Forwarder) route(r *dns.Msg) *Forward {
+	query := strings.TrimSuffix(r.Question[0].Name, ".")
+	var zone *Forward
+	if ip := queryToIP(query); ip != nil {
+		zone = fw.findZoneByIP(ip)
+	} else {
+		zone = fw.findZoneByFQDN(query)
+	}
+	return fw.zoneOrDefault(zone)
+}
+
+// usable reports whether the zone can answer, with servers or by recursion.
+func (zone *Forward) usable() bool {
+	return zone != nil && (len(zone.Servers) > 0 || zone.Recursive)
+}
+
+// zoneOrDefault returns the zone if usable, the default zone otherwise.
+func (fw *Forwarder) zoneOrDefault(zone *Forward) *Forward {
+	if zone.usable() {
+		return zone
+	}
+	fw.zonesMu.RLock()
+	defer fw.zonesMu.RUnlock()
+	return fw.defaultZone
+}
+
 // =============================================================================
 // Cache
 // =============================================================================
@@ -219,28 +419,42 @@ func (fw *Forwarder) cleanExpiredCacheEntries() {
 			}
 		}
 		fw.cacheMu.Unlock()
+
+		if fw.validator != nil {
+			fw.validator.prune()
+		}
+		recursor.prune()
 	}
 }
 
-// put an response in cache and set the Expiry to Now() + TTL
-func (fw *Forwarder) setCache(req *dns.Msg, resp *dns.Msg) {
+// put an response in cache and set the Expiry to Now() + TTL. Responses to
+// a client subnet are cached for this subnet only, unless their scope is 0
+// (RFC 7871). Truncated responses are never cached.
+func (fw *Forwarder) setCache(req *dns.Msg, resp *dns.Msg, zone string) {
 	key := requestKey(req)
-	if len(resp.Answer) != 0 {
+	if ecs := findECS(resp); findECS(req) != nil && (ecs == nil || ecs.SourceScope == 0) {
+		key = questionKey(req)
+	}
+	if len(resp.Answer) != 0 && !resp.Truncated {
 		fw.cacheMu.Lock()
 		fw.cache[key] = CacheEntry{
 			Response: resp.Copy(),
 			Expiry:   time.Now().Add(time.Duration(resp.Answer[0].Header().Ttl) * time.Second),
+			Zone:     zone,
 		}
 		fw.cacheMu.Unlock()
 	}
 }
 
-// get a response (Copy) from Cache and update the TTL
+// get a response (Copy) from Cache and update the TTL. The responses for
+// the subnet of the request come first, then the ones valid for any subnet.
 func (fw *Forwarder) getCache(req *dns.Msg) *dns.Msg {
 	defer fw.cacheMu.RUnlock()
 	fw.cacheMu.RLock()
-	key := requestKey(req)
-	entry, ok := fw.cache[key]
+	entry, ok := fw.cache[requestKey(req)]
+	if !ok && findECS(req) != nil {
+		entry, ok = fw.cache[questionKey(req)]
+	}
 	if ok && entry.Expiry.After(time.Now()) {
 		response := entry.Response.Copy()
 		ttl := time.Until(entry.Expiry).Seconds()
@@ -253,10 +467,18 @@ func (fw *Forwarder) getCache(req *dns.Msg) *dns.Msg {
 }
 
 // requestKey returns a stable cache key for the given DNS request.
-// Only query-relevant fields are included: name, type, class, and
-// the DNSSEC DO / CD flags. Transient fields (ID, EDNS0 cookie,
-// padding) are intentionally excluded.
+// Only query-relevant fields are included: name, type, class, the
+// DNSSEC DO / CD flags and the client subnet. Transient fields (ID, EDNS0
+// cookie, padding) are intentionally excluded.
 func requestKey(r *dns.Msg) string {
+	if ecs := findECS(r); ecs != nil {
+		return questionKey(r) + "|ecs=" + ecsKey(ecs)
+	}
+	return questionKey(r)
+}
+
+// questionKey is the cache key of a request, regardless of its client subnet.
+func questionKey(r *dns.Msg) string {
 	q := r.Question[0]
 	do := r.IsEdns0() != nil && r.IsEdns0().Do()
 	return fmt.Sprintf("%s %d %d|do=%t|cd=%t", q.Name, q.Qtype, q.Qclass, do, r.CheckingDisabled)
@@ -265,45 +487,53 @@ func requestKey(r *dns.Msg) string {
 func (fw *Forwarder) handleCache(w dns.ResponseWriter, r *dns.Msg) bool {
 	response := fw.getCache(r)
 	if response != nil {
+		metrics.cacheHits.Add(1)
 		response.Id = r.Id
 		w.WriteMsg(response)
 		return true
 	}
+	metrics.cacheMisses.Add(1)
 	return false
 }
 
-// forward request to forwarding servers. The first answer wins
-func (fw *Forwarder) sendRequest(servers []Server, r *dns.Msg) *dns.Msg {
-	query := r.Copy()
+// forward request to forwarding servers. The first answer wins, and is
+// returned with the server that gave it.
+func (fw *Forwarder) sendRequest(servers []Server, r *dns.Msg) (*dns.Msg, string) {
 	for _, serv := range servers {
-		c := &dns.Client{Net: serv.Scheme}
-		addr := "[" + serv.Addr + "]:" + strconv.Itoa(serv.Port)
+		c := serv.client()
+		query := upstreamQuery(serv, r)
+		start := time.Now()
 
-		// TCP/TLS → connexion persistante
+		var resp *dns.Msg
+		var err error
 		if strings.HasPrefix(serv.Scheme, "tcp") {
-			resp, err := fw.exchange(c, addr, query)
-			if err != nil {
-				continue
-			}
-			return resp
+			// TCP/TLS → connexion persistante
+			resp, err = fw.tappedExchange(c, serv, query)
+		} else {
+			// UDP → Exchange normal, retried over TCP if needed
+			resp, err = fw.exchangeUDP(c, serv, query)
 		}
-
-		// UDP → Exchange normal
-		resp, _, err := c.Exchange(query, addr)
+		if err == nil {
+			err = upstreamResponse(serv, query, resp, r)
+		}
+		metrics.upstream(serv, time.Since(start), err)
 		if err != nil {
+			log.Debugf("%s: %s", serv, err)
 			continue
 		}
-		return resp
+		return resp, serv.String()
 	}
-	return nil
+	return nil, ""
 }
 
 // exchange sends a query over a pooled TCP/TLS connection.
-// Connections are taken from the pool (exclusive use), returned if healthy,
-// discarded if broken. On pool saturation, waits briefly then reports failure
-// so sendRequest can fall back to the next server.
-func (fw *Forwarder) exchange(c *dns.Client, addr string, query *dns.Msg) (*dns.Msg, error) {
-	conn, err := fw.connPool.getConn(c, addr, poolWaitTimeout)
+// Connections are shared between concurrent queries (pipelining). If the
+// connection turns out to be dead, the query is retried once on a fresh one.
+// On pool saturation, waits briefly then reports failure so sendRequest can
+// fall back to the next server.
+func (fw *Forwarder) exchange(c *dns.Client, serv Server, query *dns.Msg) (*dns.Msg, error) {
+	addr := serv.address()
+	conn, err := fw.connPool.getConn(c, serv, serv.PoolWait)
 	if err != nil {
 		return nil, err // dial failed
 	}
@@ -311,72 +541,193 @@ func (fw *Forwarder) exchange(c *dns.Client, addr string, query *dns.Msg) (*dns.
 		return nil, fmt.Errorf("pool saturated for %s", addr)
 	}
 
-	resp, _, err := c.ExchangeWithConn(query, conn)
-	if err == nil {
-		// Healthy → return to pool for reuse
-		fw.connPool.putConn(addr, conn)
-		return resp, nil
+	resp, err := conn.exchange(query, serv.Timeout)
+	if err == nil || !conn.dead() {
+		return resp, err
 	}
 
-	// Dead/broken connection
-	log.Debugf("tcp pool: dead connection %s, discarding", addr)
-	fw.connPool.discardConn(addr)
-	conn.Close()
-
+	// Dead/broken connection (likely closed by the server while idle).
 	// One retry with a fresh connection (no wait — if pool is full, give up)
-	conn, err = fw.connPool.getConn(c, addr, 0)
+	log.Debugf("tcp pool: dead connection %s, retrying", addr)
+	conn, err = fw.connPool.getConn(c, serv, 0)
 	if err != nil {
 		return nil, err
 	}
 	if conn == nil {
 		return nil, fmt.Errorf("pool saturated for %s", addr)
 	}
+	return conn.exchange(query, serv.Timeout)
+}
 
-	resp, _, err = c.ExchangeWithConn(query, conn)
+// tappedExchange is exchange, with the query and the response sent to
+// dnstap.
+func (fw *Forwarder) tappedExchange(c *dns.Client, serv Server, query *dns.Msg) (*dns.Msg, error) {
+	tap.forwarderQuery(serv, query, time.Now())
+	resp, err := fw.exchange(c, serv, query)
 	if err == nil {
-		fw.connPool.putConn(addr, conn)
+		tap.forwarderResponse(serv, resp)
+	}
+	return resp, err
+}
+
+// exchangeUDP sends a query to a UDP server, with our DNS cookie. A server
+// rejecting the cookie (BADCOOKIE) gave us a fresh one: the query is retried
+// once with it, then over TCP. Truncated answers are retried over TCP too,
+// and only returned if TCP fails. Each exchange is sent to dnstap, with the
+// transport it used.
+func (fw *Forwarder) exchangeUDP(c *dns.Client, serv Server, query *dns.Msg) (*dns.Msg, error) {
+	addrs, err := serv.dialAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	wire := query.Copy()
+	var resp *dns.Msg
+	for range 2 {
+		if serv.Cookie {
+			upstreamCookies.add(serv, wire)
+		}
+		tap.forwarderQuery(serv, wire, time.Now())
+		if resp, err = exchangeAny(c, wire, addrs); err != nil {
+			return nil, err
+		}
+		tap.forwarderResponse(serv, resp)
+		if serv.Cookie {
+			if err := upstreamCookies.check(serv, resp); err != nil {
+				return nil, err
+			}
+		}
+		if !serv.Cookie || resp.Rcode != dns.RcodeBadCookie {
+			break
+		}
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeBadCookie:
+		log.Debugf("%s: bad cookie, retrying over TCP", serv)
+	case resp.Truncated:
+		log.Debugf("%s: truncated answer, retrying over TCP", serv)
+	default:
+		return resp, nil
+	}
+	tcpResp, err := fw.exchangeTCP(serv, query)
+	if err != nil && resp.Truncated {
+		log.Debugf("%s: %s, keeping the truncated answer", serv, err)
 		return resp, nil
 	}
+	return tcpResp, err
+}
 
-	fw.connPool.discardConn(addr)
-	conn.Close()
+// exchangeAny sends a query to the addresses of a server in turn, until one
+// answers.
+func exchangeAny(c *dns.Client, query *dns.Msg, addrs []string) (resp *dns.Msg, err error) {
+	for _, addr := range addrs {
+		if resp, _, err = c.Exchange(query, addr); err == nil {
+			return resp, nil
+		}
+		log.Debugf("%s: %s", addr, err)
+	}
 	return nil, err
 }
 
-// handle reverse request
-func (fw *Forwarder) handleRRequest(ip net.IP, w dns.ResponseWriter, r *dns.Msg) {
-	tmp := fw.findServersByIP(ip)
-	fw._handleRequest(tmp, w, r)
+// exchangeTCP sends a query to a UDP server over a pooled TCP connection.
+func (fw *Forwarder) exchangeTCP(serv Server, query *dns.Msg) (*dns.Msg, error) {
+	serv.Scheme = "tcp"
+	return fw.tappedExchange(serv.client(), serv, query)
+}
+
+// handle reverse request, returns the source of the answer
+func (fw *Forwarder) handleRRequest(ip net.IP, w dns.ResponseWriter, r *dns.Msg) string {
+	tmp := fw.findZoneByIP(ip)
+	return fw._handleRequest(tmp, w, r)
+}
+
+// handle direct request, returns the source of the answer
+func (fw *Forwarder) handleRequest(fqdn string, w dns.ResponseWriter, r *dns.Msg) string {
+	tmp := fw.findZoneByFQDN(fqdn)
+	return fw._handleRequest(tmp, w, r)
+}
+
+func (fw *Forwarder) _handleRequest(zone *Forward, w dns.ResponseWriter, r *dns.Msg) string {
+	zone = fw.zoneOrDefault(zone)
+	resp, source := fw.resolve(zone, r)
+	if resp == nil {
+		return ""
+	}
+	truncateToFit(resp, r)
+	w.WriteMsg(resp)
+	return source
 }
 
-// handle direct request
-func (fw *Forwarder) handleRequest(fqdn string, w dns.ResponseWriter, r *dns.Msg) {
-	tmp := fw.findServersByFQDN(fqdn)
-	fw._handleRequest(tmp, w, r)
+// resolve forwards the request and caches the answer. Concurrent identical
+// requests (same requestKey) are coalesced: only the first one goes
+// upstream, the others wait for its answer. Each caller gets its own copy
+// carrying its own message ID, and the source of the answer.
+func (fw *Forwarder) resolve(zone *Forward, r *dns.Msg) (*dns.Msg, string) {
+	key := requestKey(r)
+
+	fw.inflightMu.Lock()
+	if call, ok := fw.inflight[key]; ok {
+		fw.inflightMu.Unlock()
+		log.Debugf("coalescing %s", key)
+		<-call.done
+		return replyCopy(call.resp, r), call.source
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	fw.inflight[key] = call
+	fw.inflightMu.Unlock()
+
+	call.resp, call.source = fw.forward(zone, r)
+
+	fw.inflightMu.Lock()
+	delete(fw.inflight, key)
+	fw.inflightMu.Unlock()
+	close(call.done)
+
+	return replyCopy(call.resp, r), call.source
 }
 
-func (fw *Forwarder) _handleRequest(servers []Server, w dns.ResponseWriter, r *dns.Msg) {
-	if len(servers) == 0 {
-		servers = fw.defaultServers
+// forward sends the request to the zone servers, or resolves it from the
+// root servers for a recursive zone (the servers being the fallback), and
+// caches the answer. It returns the source of the answer too.
+func (fw *Forwarder) forward(zone *Forward, r *dns.Msg) (*dns.Msg, string) {
+	if fw.validator != nil && !zone.NTA && !r.CheckingDisabled {
+		return fw.forwardValidated(zone, r)
 	}
-	resp := fw.sendRequest(servers, r)
+	if zone.Recursive {
+		if resp := recursor.resolve(r); resp != nil {
+			fw.setCache(r, resp, zone.Name)
+			return resp, sourceRecursion
+		}
+	}
+	resp, source := fw.sendRequest(zone.Servers, r)
 	if resp == nil {
-		return
+		return nil, ""
 	}
 	// DS queries need a recursive resolver (DS lives in parent zone).
 	// If the zone server is authoritative-only (ra=0), fall back to
 	// default servers which are assumed to support recursion.
 	if r.Question[0].Qtype == dns.TypeDS && !resp.MsgHdr.RecursionAvailable {
-		if fallback := fw.sendRequest(fw.defaultServers, r); fallback != nil {
-			truncateToFit(fallback, r)
-			fw.setCache(r, fallback)
-			w.WriteMsg(fallback)
-			return
+		fw.zonesMu.RLock()
+		defaultServers := fw.defaultServers
+		fw.zonesMu.RUnlock()
+		if fallback, server := fw.sendRequest(defaultServers, r); fallback != nil {
+			resp, source = fallback, server
 		}
 	}
-	truncateToFit(resp, r)
-	fw.setCache(r, resp)
-	w.WriteMsg(resp)
+	fw.setCache(r, resp, zone.Name)
+	return resp, source
+}
+
+// replyCopy returns a private copy of a shared upstream answer, with the
+// message ID of the given request.
+func replyCopy(resp *dns.Msg, r *dns.Msg) *dns.Msg {
+	if resp == nil {
+		return nil
+	}
+	reply := resp.Copy()
+	reply.Id = r.Id
+	return reply
 }
 
 // truncateToFit ensures the DNS response fits within the client's UDP buffer,
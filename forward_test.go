@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Concurrent identical queries share one upstream exchange, each client
+// getting its own copy of the answer, with its own ID.
+func TestResolveCoalescing(t *testing.T) {
+	var exchanges atomic.Int32
+	addr := serveTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		exchanges.Add(1)
+		time.Sleep(200 * time.Millisecond) // long enough for every client to ask
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	}), "127.0.0.1:0")
+	fw := newTestForwarder(t, addr)
+
+	const clients = 20
+	resps := make([]*dns.Msg, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := new(dns.Msg)
+			r.SetQuestion("www.example.com.", dns.TypeA)
+			r.Id = uint16(1000 + i)
+			resps[i], _ = fw.resolve(fw.defaultZone, r)
+		}()
+	}
+	wg.Wait()
+
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("%d upstream exchanges, want 1", n)
+	}
+	for i, resp := range resps {
+		if resp == nil {
+			t.Fatalf("client %d: no answer", i)
+		}
+		if resp.Id != uint16(1000+i) {
+			t.Errorf("client %d: id %d, want %d", i, resp.Id, 1000+i)
+		}
+	}
+	// a client changing its answer doesn't change the others
+	resps[0].Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99")
+	resps[0].Answer = append(resps[0].Answer, resps[0].Answer[0])
+	for i, resp := range resps[1:] {
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("client %d: answer changed to %v", i+1, resp.Answer)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -17,54 +19,106 @@ type record struct {
 }
 
 type LocalServ struct {
+	filename      string
 	recordsByHost map[string]record
+	mu            sync.RWMutex // protects recordsByHost, replaced on reload
 }
 
 func newLocalServer(filename string) *LocalServ {
 	ls := new(LocalServ)
-	ls.recordsByHost = map[string]record{}
-	ls.loadRecords(filename)
+	ls.filename = filename
+	records, problems, err := readRecords(filename)
+	if err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+	for _, problem := range problems {
+		log.Warning(problem)
+	}
+	ls.recordsByHost = records
 	return ls
 }
 
-func (ls *LocalServ) loadRecords(filename string) {
+// loadRecords reads hosts.txt again, without using its records yet.
+func (ls *LocalServ) loadRecords() (map[string]record, error) {
+	records, problems, err := readRecords(ls.filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range problems {
+		log.Warning(problem)
+	}
+	return records, nil
+}
+
+// reload replaces the records by the ones of loadRecords.
+func (ls *LocalServ) reload(records map[string]record) {
+	ls.mu.Lock()
+	ls.recordsByHost = records
+	ls.mu.Unlock()
+	ls.info()
+}
+
+// readRecords reads a hosts file. Malformed lines and addresses are
+// returned as problems, along with the records.
+func readRecords(filename string) (map[string]record, []error, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("Failed to open records file: %s\n", err.Error())
+		return nil, nil, fmt.Errorf("Failed to open records file: %w", err)
 	}
 	defer file.Close()
 
 	// Read the records from the file and populate the recordsByHost map
 	// Assuming each line in the file contains: hostname [ipv4] [ipv6] [text]
+	recordsByHost := map[string]record{}
+	var problems []error
+	problem := func(n int, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("%s:%d: "+format, append([]any{filename, n}, args...)...))
+	}
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	for n := 1; scanner.Scan(); n++ {
 		var ipv4, ipv6 net.IP
 
 		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
 		fields := strings.Split(line, ",")
 		if len(fields) < 2 {
+			problem(n, "MISSING ADDRESS: %s", line)
 			continue
 		}
 		// fields
 		host := fields[0]
 		if len(fields) > 1 {
 			ipv4 = net.ParseIP(fields[1])
+			if ipv4 == nil || ipv4.To4() == nil {
+				problem(n, "INVALID IPV4 ADDRESS: %s", fields[1])
+			}
 		}
 		if len(fields) > 2 {
 			ipv6 = net.ParseIP(fields[2])
+			if fields[2] != "" && (ipv6 == nil || ipv6.To4() != nil) {
+				problem(n, "INVALID IPV6 ADDRESS: %s", fields[2])
+			}
 		}
 		text := ""
 		if len(fields) > 3 {
 			text = fields[3]
 		}
-		ls.recordsByHost[host] = record{IPv4: ipv4, IPv6: ipv6, Text: text}
+		if _, ok := recordsByHost[host]; ok {
+			problem(n, "DUPLICATE HOST: %s", host)
+		}
+		recordsByHost[host] = record{IPv4: ipv4, IPv6: ipv6, Text: text}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading records file: %s\n", err.Error())
+		return nil, nil, fmt.Errorf("Error reading records file: %w", err)
 	}
+	return recordsByHost, problems, nil
 }
 
 func (ls *LocalServ) info() {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
 	log.Infof("Loaded %d hosts\n", len(ls.recordsByHost))
 }
 
@@ -74,6 +128,8 @@ func (ls *LocalServ) info() {
 
 // search if we have a record for this IP
 func (ls *LocalServ) findRecordByIP(ip net.IP) (host string, record record, found bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
 	for k, r := range ls.recordsByHost {
 		if r.IPv4.Equal(ip) || r.IPv6.Equal(ip) {
 			host = k
@@ -87,6 +143,8 @@ func (ls *LocalServ) findRecordByIP(ip net.IP) (host string, record record, foun
 
 // search if we have a record for a fqdn
 func (ls *LocalServ) findRecordByFQDN(fqdn string) (record record, found bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
 	record, found = ls.recordsByHost[fqdn]
 	return
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    string
+		hosts    int
+		problems []string
+	}{
+		{"records", "www,192.0.2.1\nmail,192.0.2.2,2001:db8::2,mail server\nv6,192.0.2.3,2001:db8::3", 3, nil},
+		{"comments and blank lines", "# hosts\n\n  # indented\nwww,192.0.2.1\n   \n", 1, nil},
+		{"empty IPv6", "www,192.0.2.1,,text", 1, nil},
+		{"missing address", "www", 0, []string{"hosts.txt:1: MISSING ADDRESS: www"}},
+		{"invalid IPv4", "www,192.0.2", 1, []string{"hosts.txt:1: INVALID IPV4 ADDRESS: 192.0.2"}},
+		{"IPv6 as IPv4", "www,2001:db8::1", 1, []string{"INVALID IPV4 ADDRESS"}},
+		{"IPv4 as IPv6", "www,192.0.2.1,192.0.2.2", 1, []string{"INVALID IPV6 ADDRESS"}},
+		{"duplicate host", "www,192.0.2.1\nftp,192.0.2.2\nwww,192.0.2.3", 2, []string{"hosts.txt:3: DUPLICATE HOST: www"}},
+		{"every problem", "www\nwww,1.2.3\nftp,192.0.2.1\nftp,192.0.2.2", 2,
+			[]string{"hosts.txt:1: MISSING", "hosts.txt:2: INVALID IPV4", "hosts.txt:4: DUPLICATE"}},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "hosts.txt")
+		if err := os.WriteFile(filename, []byte(tt.lines), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		records, problems, err := readRecords(filename)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if len(records) != tt.hosts {
+			t.Errorf("%s: %d hosts, want %d", tt.name, len(records), tt.hosts)
+		}
+		if len(problems) != len(tt.problems) {
+			t.Errorf("%s: problems %v, want %v", tt.name, problems, tt.problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.Contains(problem.Error(), tt.problems[i]) {
+				t.Errorf("%s: got %s, want %s", tt.name, problem, tt.problems[i])
+			}
+		}
+	}
+
+	if _, _, err := readRecords(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file read")
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -10,36 +15,61 @@ import (
 
 func requestHandler(local *LocalServ, fw *Forwarder) func(dns.ResponseWriter, *dns.Msg) {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
-		q := r.Question[0]
-		query := q.Name[:len(q.Name)-1]
-
-		// is it in cache ?
-		if fw.handleCache(w, r) {
-			return
+		// count and log the query once answered, with the zone and the
+		// source of the answer
+		start := time.Now()
+		aw := &answerWriter{ResponseWriter: w}
+		tap.clientQuery(w, r, start)
+		zone, source := answer(local, fw, aw, r)
+		if zone == "" {
+			zone = fw.route(r).Name
 		}
+		metrics.query(r, aw, zone)
+		queryLog.log(r, aw, zone, source, time.Since(start))
+		tap.clientResponse(w, aw.msg)
+	}
+}
 
-		log.Debugf("requestHandler %s", query)
-		// is it a reverse query ?
-		ip := queryToIP(query)
-		if ip != nil {
-			if local.handleRRequest(ip, w, r) {
-				return
-			} else {
-				fw.handleRRequest(ip, w, r)
-				return
-			}
-		}
-		// direct query
-		if local.handleRequest(query, w, r) {
-			return
+// answer answers a query from the cache, hosts.txt or the zone servers. It
+// returns the zone of the answer when known, and its source.
+func answer(local *LocalServ, fw *Forwarder, w dns.ResponseWriter, r *dns.Msg) (zone, source string) {
+	// DNS cookies, may ask the client to retry
+	w, ok := serverCookies.apply(w, r)
+	if !ok {
+		return
+	}
+
+	// client subnet policy of the zone
+	w, r = fw.applyECS(w, r)
+
+	q := r.Question[0]
+	query := q.Name[:len(q.Name)-1]
+
+	// is it in cache ?
+	if fw.handleCache(w, r) {
+		source = sourceCache
+		return
+	}
+
+	log.Debugf("requestHandler %s", query)
+	// is it a reverse query ?
+	ip := queryToIP(query)
+	if ip != nil {
+		if local.handleRRequest(ip, w, r) {
+			return localZoneName, sourceLocal
 		} else {
-			fw.handleRequest(query, w, r)
-			return
+			return "", fw.handleRRequest(ip, w, r)
 		}
 	}
+	// direct query
+	if local.handleRequest(query, w, r) {
+		return localZoneName, sourceLocal
+	} else {
+		return "", fw.handleRequest(query, w, r)
+	}
 }
 
-// server
+// server, runs until SIGINT or SIGTERM
 func runServer(bindAddr string, port int, handler func(dns.ResponseWriter, *dns.Msg)) {
 	log.Infof("Owns NS (dns lib version %s)", dns.Version.String())
 	addr := bindAddr + ":" + strconv.Itoa(port)
@@ -64,35 +94,122 @@ func runServer(bindAddr string, port int, handler func(dns.ResponseWriter, *dns.
 	defer tcpServer.Shutdown()
 
 	log.Infof("DNS server listening on port %d (UDP+TCP)", port)
-	select {}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	log.Infof("Received %s, shutting down", s)
+}
+
+// setLogLevel sets the log level: INFO, DEBUG, or WARNING for the commands.
+func setLogLevel(level string) error {
+	switch level {
+	case "INFO":
+		log.SetLevel(log.InfoLevel)
+	case "DEBUG":
+		log.SetLevel(log.DebugLevel)
+	case "WARNING":
+		log.SetLevel(log.WarnLevel)
+	default:
+		return fmt.Errorf("Invalid log level: %s", level)
+	}
+	return nil
 }
 
 func main() {
+	// commands: check, query, explain
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// Set default values
 	defaultBindAddr := "[::]"
 	defaultPort := 53
-	defaultConfDir := "/etc/owns"
+	defaultConfDir := defaultConfigDir
 	defaultLogLevel := "INFO"
+	defaultCacheFile := ""
+	defaultControlSocket := ""
+	defaultBootstrapServers := defaultBootstrap
+	defaultRootServers := defaultRootHints
+	defaultDNSSEC := false
+	defaultTrustAnchorFile := ""
+	defaultMetricsAddr := ""
+	defaultQueryLog := ""
+	defaultQueryLogExclude := ""
+	defaultDnstap := ""
+	defaultAdminAddr := ""
+	defaultAdminTokenFile := ""
+	defaultDnstapIdentity, _ := os.Hostname()
 
 	var bindAddr string
 	var port int
 	var confDir string
 	var logLevel string
+	var cacheFile string
+	var controlSocket string
+	var bootstrapServers string
+	var rootHints string
+	var dnssec bool
+	var trustAnchorFile string
+	var metricsAddr string
+	var queryLogSink string
+	var queryLogMaxSize int64
+	var queryLogBackups int
+	var queryLogSample float64
+	var queryLogExclude string
+	var dnstapSink string
+	var dnstapIdentity string
+	var adminAddr string
+	var adminTokenFile string
+	var strict bool
+	var longestMatch bool
 
 	// Define flags for bindAddr, port, and confDir, logLevel and assign their values to variables
 	flag.StringVar(&bindAddr, "bindAddr", defaultBindAddr, "Address to which the server should bind")
 	flag.IntVar(&port, "port", defaultPort, "Port on which the server should listen")
 	flag.StringVar(&confDir, "confDir", defaultConfDir, "Configuration directory")
+	flag.BoolVar(&strict, "strict", false, "Reject forward.yaml on any problem: unknown fields, invalid or shadowed entries, zones without servers, several default blocks")
+	flag.BoolVar(&longestMatch, "longestMatch", false, "Route to the zone of the most specific network or domain, whatever the order of forward.yaml")
 	flag.StringVar(&logLevel, "logLevel", defaultLogLevel, "Log level (e.g., INFO, DEBUG)")
+	flag.StringVar(&cacheFile, "cacheFile", defaultCacheFile, "File to persist the cache across restarts (disabled if empty)")
+	flag.StringVar(&controlSocket, "controlSocket", defaultControlSocket, "Unix socket for control commands (disabled if empty)")
+	flag.StringVar(&metricsAddr, "metricsAddr", defaultMetricsAddr, "Address of the Prometheus metrics listener, e.g. 127.0.0.1:9153 (disabled if empty)")
+	flag.StringVar(&queryLogSink, "queryLog", defaultQueryLog, "Query log: stdout, syslog or a file name (disabled if empty)")
+	flag.Int64Var(&queryLogMaxSize, "queryLogMaxSize", defaultQueryLogMaxSize, "Size in MB of the query log file before rotation")
+	flag.IntVar(&queryLogBackups, "queryLogBackups", defaultQueryLogBackups, "Rotated query log files kept")
+	flag.Float64Var(&queryLogSample, "queryLogSample", 1, "Fraction of the queries logged (0 to 1)")
+	flag.StringVar(&queryLogExclude, "queryLogExclude", defaultQueryLogExclude, "Comma separated domains not logged")
+	flag.StringVar(&adminAddr, "adminAddr", defaultAdminAddr, "Admin API: unix:/path/to/socket or a loopback address, e.g. 127.0.0.1:8053 (disabled if empty)")
+	flag.StringVar(&adminTokenFile, "adminTokenFile", defaultAdminTokenFile, "File holding the bearer token of the admin API (required on TCP)")
+	flag.StringVar(&dnstapSink, "dnstap", defaultDnstap, "dnstap output: unix:/path/to/socket or a file name (disabled if empty)")
+	flag.StringVar(&dnstapIdentity, "dnstapIdentity", defaultDnstapIdentity, "Identity of the server in the dnstap messages")
+	flag.StringVar(&bootstrapServers, "bootstrap", defaultBootstrapServers, "Comma separated IPs resolving upstream host names")
+	flag.StringVar(&rootHints, "rootHints", defaultRootServers, "Comma separated IPs of the root servers (recursive zones)")
+	flag.BoolVar(&dnssec, "dnssec", defaultDNSSEC, "Validate the upstream answers with DNSSEC")
+	flag.StringVar(&trustAnchorFile, "trustAnchorFile", defaultTrustAnchorFile, "File keeping the root trust anchors up to date (built-in anchors if empty)")
+	flag.BoolVar(&serverCookies.enabled, "cookies", true, "Answer the DNS cookies of the clients (RFC 7873)")
+	flag.BoolVar(&serverCookies.required, "cookieRequired", false, "Ask UDP clients without a valid server cookie to retry")
+	flag.IntVar(&serverCookies.limit, "cookielessLimit", defaultCookielessLimit, "UDP queries per second of a client without a valid server cookie before asking it to retry (0 for no limit)")
+	flag.DurationVar(&serverDefaults.Timeout, "timeout", defaultUpstreamTimeout, "Default upstream timeout")
+	flag.IntVar(&serverDefaults.PoolSize, "poolSize", defaultMaxPerServer, "Default maximum TCP/TLS connections per upstream")
+	flag.DurationVar(&serverDefaults.PoolWait, "poolWait", defaultPoolWait, "Default wait for a saturated TCP/TLS pool before falling back")
 
+	flag.Usage = usage
 	flag.Parse()
-	switch logLevel {
-	case "INFO":
-		log.SetLevel(log.InfoLevel)
-	case "DEBUG":
-		log.SetLevel(log.DebugLevel)
-	default:
-		log.Fatalf("Invalid log level: %s", logLevel)
+	if err := setLogLevel(logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := bootstrap.setServers(bootstrapServers); err != nil {
+		log.Fatal(err)
+	}
+	if err := recursor.setRootHints(rootHints); err != nil {
+		log.Fatal(err)
+	}
+	if serverDefaults.PoolSize < 1 || serverDefaults.PoolWait < 0 || serverDefaults.Timeout <= 0 {
+		log.Fatalf("Invalid pool size or timeouts")
 	}
 
 	log.SetFormatter(&log.TextFormatter{
@@ -100,11 +217,64 @@ func main() {
 		FullTimestamp:   true,
 	})
 
-	forward := newForwarder(confDir + "/forward.yaml")
+	forward := newForwarder(confDir+"/forward.yaml", configMode{strict: strict, longestMatch: longestMatch})
 	forward.info()
+	if dnssec {
+		anchors, err := newTrustAnchors(trustAnchorFile)
+		if err != nil {
+			log.Fatalf("Error loading trust anchors: %s", err)
+		}
+		forward.validator = newValidator(forward, anchors)
+		log.Infof("DNSSEC validation enabled")
+	}
+	if cacheFile != "" {
+		if err := forward.loadCache(cacheFile); err != nil {
+			log.Warningf("Error loading cache: %s", err)
+		}
+		go forward.persistCache(cacheFile)
+	}
+	go forward.flushOnSignal()
+	if controlSocket != "" {
+		go runControl(controlSocket, forward)
+	}
+	if queryLogSink != "" {
+		var err error
+		queryLog, err = newQueryLog(queryLogSink, queryLogMaxSize<<20, queryLogBackups, queryLogSample, queryLogExclude)
+		if err != nil {
+			log.Fatalf("Error opening query log: %s", err)
+		}
+	}
+	if dnstapSink != "" {
+		var err error
+		tap, err = newDnstap(dnstapSink, dnstapIdentity)
+		if err != nil {
+			log.Fatalf("Error opening dnstap output: %s", err)
+		}
+	}
+	if metricsAddr != "" {
+		go runMetrics(metricsAddr, forward)
+	}
 	local := newLocalServer(confDir + "/hosts.txt")
 	local.info()
+	if adminAddr != "" {
+		var token string
+		if adminTokenFile != "" {
+			var err error
+			if token, err = readToken(adminTokenFile); err != nil {
+				log.Fatalf("Error reading admin token: %s", err)
+			}
+		}
+		go runAdmin(adminAddr, token, forward, local)
+	}
 
 	handler := requestHandler(local, forward)
 	runServer(bindAddr, port, handler)
+	tap.close()
+	queryLog.close()
+
+	if cacheFile != "" {
+		if err := forward.saveCache(cacheFile); err != nil {
+			log.Warningf("Error saving cache: %s", err)
+		}
+	}
 }
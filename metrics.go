@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Prometheus metrics
+// =============================================================================
+
+// Metrics counts the queries and the upstream exchanges, exported in the
+// Prometheus text format by the -metricsAddr listener. The cache and pool
+// gauges are read when scraped.
+type Metrics struct {
+	mu          sync.Mutex
+	queries     map[queryLabels]uint64
+	upstreams   map[string]*upstreamMetrics // by server
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+}
+
+type queryLabels struct {
+	qtype, rcode, zone, transport string
+}
+
+// upstreamMetrics holds the latency histogram and the errors of a server,
+// and its last exchanges for the admin API.
+type upstreamMetrics struct {
+	buckets     []uint64 // per bucket of upstreamLatencyBuckets, not cumulative
+	count       uint64
+	sum         float64
+	errors      uint64
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+var metrics = &Metrics{
+	queries:   map[queryLabels]uint64{},
+	upstreams: map[string]*upstreamMetrics{},
+}
+
+// query counts a client query and the rcode of its response.
+func (m *Metrics) query(r *dns.Msg, w *answerWriter, zone string) {
+	labels := queryLabels{
+		qtype:     dns.TypeToString[r.Question[0].Qtype],
+		rcode:     w.rcodeName(),
+		zone:      zone,
+		transport: w.transport(),
+	}
+	m.mu.Lock()
+	m.queries[labels]++
+	m.mu.Unlock()
+}
+
+// upstream records an exchange with a server: its latency, or its error.
+func (m *Metrics) upstream(serv Server, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.upstreams[serv.String()]
+	if u == nil {
+		u = &upstreamMetrics{buckets: make([]uint64, len(upstreamLatencyBuckets))}
+		m.upstreams[serv.String()] = u
+	}
+	if err != nil {
+		u.errors++
+		u.lastFailure, u.lastError = time.Now(), err.Error()
+		return
+	}
+	u.lastSuccess = time.Now()
+	seconds := elapsed.Seconds()
+	if i, _ := slices.BinarySearch(upstreamLatencyBuckets, seconds); i < len(u.buckets) {
+		u.buckets[i]++
+	}
+	u.count++
+	u.sum += seconds
+}
+
+// answerWriter remembers the response sent to a client, for the metrics,
+// the query log and dnstap.
+type answerWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *answerWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// rcodeName is the rcode of the response, "none" if none was sent.
+func (w *answerWriter) rcodeName() string {
+	if w.msg == nil {
+		return "none"
+	}
+	return dns.RcodeToString[w.msg.Rcode]
+}
+
+func (w *answerWriter) transport() string {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// runMetrics serves the metrics over HTTP, on /metrics.
+func runMetrics(addr string, fw *Forwarder) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, fw)
+	})
+	log.Infof("Metrics listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Failed to start metrics listener: %s\n", err.Error())
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs: name, value, name, value...
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// write writes every metric in the Prometheus text format.
+func (m *Metrics) write(out io.Writer, fw *Forwarder) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	m.mu.Lock()
+	header("owns_queries_total", "counter", "Client queries by type, response code, zone and transport.")
+	var lines []string
+	for l, n := range m.queries {
+		lines = append(lines, fmt.Sprintf("owns_queries_total%s %d",
+			labels("qtype", l.qtype, "rcode", l.rcode, "zone", l.zone, "transport", l.transport), n))
+	}
+	slices.Sort(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+
+	servers := make([]string, 0, len(m.upstreams))
+	for server := range m.upstreams {
+		servers = append(servers, server)
+	}
+	slices.Sort(servers)
+	header("owns_upstream_duration_seconds", "histogram", "Latency of the upstream exchanges.")
+	for _, server := range servers {
+		u := m.upstreams[server]
+		var cumulative uint64
+		for i, le := range upstreamLatencyBuckets {
+			cumulative += u.buckets[i]
+			fmt.Fprintf(w, "owns_upstream_duration_seconds_bucket%s %d\n",
+				labels("server", server, "le", strconv.FormatFloat(le, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "owns_upstream_duration_seconds_bucket%s %d\n", labels("server", server, "le", "+Inf"), u.count)
+		fmt.Fprintf(w, "owns_upstream_duration_seconds_sum%s %g\n", labels("server", server), u.sum)
+		fmt.Fprintf(w, "owns_upstream_duration_seconds_count%s %d\n", labels("server", server), u.count)
+	}
+	header("owns_upstream_errors_total", "counter", "Failed upstream exchanges.")
+	for _, server := range servers {
+		fmt.Fprintf(w, "owns_upstream_errors_total%s %d\n", labels("server", server), m.upstreams[server].errors)
+	}
+	m.mu.Unlock()
+
+	header("owns_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "owns_cache_hits_total %d\n", m.cacheHits.Load())
+	header("owns_cache_misses_total", "counter", "Queries not found in the cache.")
+	fmt.Fprintf(w, "owns_cache_misses_total %d\n", m.cacheMisses.Load())
+	fw.cacheMu.RLock()
+	size := len(fw.cache)
+	fw.cacheMu.RUnlock()
+	header("owns_cache_entries", "gauge", "Entries in the cache, expired ones included until pruned.")
+	fmt.Fprintf(w, "owns_cache_entries %d\n", size)
+
+	stats := fw.connPool.stats()
+	addrs := make([]string, 0, len(stats))
+	for addr := range stats {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+	pool := []struct {
+		name, kind, help string
+		value            func(poolStats) uint64
+	}{
+		{"owns_pool_connections", "gauge", "Open TCP/TLS connections.", func(s poolStats) uint64 { return uint64(s.total) }},
+		{"owns_pool_idle_connections", "gauge", "Open TCP/TLS connections without pending query.", func(s poolStats) uint64 { return uint64(s.idle) }},
+		{"owns_pool_waiting", "gauge", "Queries waiting for room in a saturated pool.", func(s poolStats) uint64 { return uint64(s.waiting) }},
+		{"owns_pool_saturated_total", "counter", "Queries that gave up on a saturated pool.", func(s poolStats) uint64 { return s.saturated }},
+	}
+	for _, p := range pool {
+		header(p.name, p.kind, p.help)
+		for _, addr := range addrs {
+			fmt.Fprintf(w, "%s%s %d\n", p.name, labels("server", addr), p.value(stats[addr]))
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"sync"
 	"time"
 
@@ -8,84 +11,450 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// errConnClosed is reported to queries still waiting on a connection
+	// that has been closed.
+	errConnClosed = errors.New("connection closed")
 
-// ConnPool manages a small pool of persistent TCP/TLS connections per address.
-// Only one goroutine uses a connection at a time; idle connections are returned
-// to the pool for reuse.
+	// errIdle is the reason given when the pool closes an idle connection.
+	errIdle = errors.New("idle timeout")
+
+	// errWedged is the reason given when a connection stops answering.
+	errWedged = errors.New("too many timeouts")
+)
+
+// ConnPool manages a small pool of persistent TCP/TLS connections per server.
+// Servers are identified by their URL and zone options: the same address with
+// different TLS options or source gets separate connections.
+// Connections are shared: many queries are pipelined on the same connection
+// (RFC 7766) and answers are matched back by message ID. A new connection is
+// only dialed when every existing one is full. Idle connections are closed
+// before the server does it; warm-up servers always keep a few open.
 type ConnPool struct {
-	mu    sync.Mutex
-	cond  *sync.Cond
-	idle  map[string][]*dns.Conn // idle connections, ready for reuse
-	total map[string]int         // total connections (idle + in-use) per address
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conns   map[string][]*muxConn // live connections per server key
+	dialing map[string]int        // dials in progress per server key
+	warm    map[string]warmServer // servers with warm-up connections
+
+	waiting   map[string]int    // queries waiting for room per server key
+	saturated map[string]uint64 // queries that gave up per server key
+}
+
+// warmServer is a server whose pool keeps a minimum number of connections.
+type warmServer struct {
+	client *dns.Client
+	server Server
 }
 
 func newConnPool() *ConnPool {
 	p := &ConnPool{
-		idle:  make(map[string][]*dns.Conn),
-		total: make(map[string]int),
+		conns:   make(map[string][]*muxConn),
+		dialing: make(map[string]int),
+		warm:    make(map[string]warmServer),
+
+		waiting:   make(map[string]int),
+		saturated: make(map[string]uint64),
 	}
 	p.cond = sync.NewCond(&p.mu)
+	go p.reapIdleConns()
 	return p
 }
 
-// getConn returns an idle connection, dials a new one if under max,
-// or returns nil, nil if pool is saturated and timeout expired (caller should fallback).
-func (p *ConnPool) getConn(c *dns.Client, addr string, timeout time.Duration) (*dns.Conn, error) {
+// getConn returns the least loaded connection able to take one more query,
+// dials a new one if under max, or returns nil, nil if the pool is saturated
+// and timeout expired (caller should fallback).
+func (p *ConnPool) getConn(c *dns.Client, serv Server, timeout time.Duration) (*muxConn, error) {
+	addr := serv.key()
 	deadline := time.Now().Add(timeout)
+	if timeout > 0 {
+		// sync.Cond has no timed wait: wake the waiters at the deadline
+		timer := time.AfterFunc(timeout, p.wakeup)
+		defer timer.Stop()
+	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	for {
-		// 1. Try to grab an idle connection
-		if conns, ok := p.idle[addr]; ok && len(conns) > 0 {
-			last := len(conns) - 1
-			conn := conns[last]
-			p.idle[addr] = conns[:last]
-			log.Debugf("tcp pool: reuse connection %s (idle=%d, total=%d)",
-				addr, len(p.idle[addr]), p.total[addr])
-			return conn, nil
+		// 1. Try the least loaded live connection
+		var best *muxConn
+		for _, mc := range p.conns[addr] {
+			if n := mc.inflight(); n < maxInflightPerConn && (best == nil || n < best.inflight()) {
+				best = mc
+			}
+		}
+		if best != nil {
+			log.Debugf("tcp pool: reuse connection %s (inflight=%d, total=%d)",
+				addr, best.inflight(), len(p.conns[addr]))
+			return best, nil
 		}
 
 		// 2. Under max → dial a new one
-		if p.total[addr] < defaultMaxPerServer {
-			p.total[addr]++
-			currentTotal := p.total[addr]
+		total := len(p.conns[addr]) + p.dialing[addr]
+		if total < serv.PoolSize {
+			p.dialing[addr]++
 			p.mu.Unlock() // release during dial (can be slow)
 
-			log.Debugf("tcp pool: dial new connection %s (total=%d/%d)", addr, currentTotal-1, defaultMaxPerServer)
-			conn, err := c.Dial(addr)
+			log.Debugf("tcp pool: dial new connection %s (total=%d/%d)", addr, total, serv.PoolSize)
+			mc, err := p.dial(c, serv)
 
 			p.mu.Lock() // reacquire for deferred unlock
-			if err != nil {
-				p.total[addr]--
-				return nil, err
-			}
-			return conn, nil
+			return mc, err
 		}
 
-		// 3. Pool saturated — wait for a connection to be returned
+		// 3. Pool saturated — wait for a query to complete
 		if timeout == 0 || time.Now().After(deadline) {
+			p.saturated[addr]++
 			return nil, nil // signal: pool full, caller should fall back
 		}
 
+		p.waiting[addr]++
 		p.cond.Wait() // releases mu, waits for Signal, reacquires mu
+		p.waiting[addr]--
+	}
+}
+
+// dial opens a new connection and adds it to the pool. The caller must have
+// counted it in p.dialing, and must not hold p.mu.
+func (p *ConnPool) dial(c *dns.Client, serv Server) (*muxConn, error) {
+	addr := serv.key()
+	conn, err := serv.dial(c)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing[addr]--
+	p.cond.Broadcast() // a new connection has room, or a slot freed up
+	if err != nil {
+		return nil, err
 	}
+	mc := newMuxConn(p, serv, conn)
+	p.conns[addr] = append(p.conns[addr], mc)
+	return mc, nil
 }
 
-// putConn returns a healthy connection to the idle pool.
-func (p *ConnPool) putConn(addr string, conn *dns.Conn) {
+// keepWarm registers a server whose pool always keeps serv.Warm connections
+// open, and opens them.
+func (p *ConnPool) keepWarm(c *dns.Client, serv Server) {
 	p.mu.Lock()
-	p.idle[addr] = append(p.idle[addr], conn)
+	p.warm[serv.key()] = warmServer{client: c, server: serv}
 	p.mu.Unlock()
-	p.cond.Signal() // wake one waiter
+	p.fillWarm()
 }
 
-// discardConn removes a dead/broken connection from the count.
-// Caller is responsible for conn.Close().
-func (p *ConnPool) discardConn(addr string) {
+// clearWarm forgets the warm-up servers, before the zones are reloaded.
+// Their connections are closed once idle, as any others.
+func (p *ConnPool) clearWarm() {
 	p.mu.Lock()
-	p.total[addr]--
+	clear(p.warm)
 	p.mu.Unlock()
-	p.cond.Signal() // a slot freed up
+}
+
+// fillWarm dials the missing warm-up connections in the background.
+func (p *ConnPool) fillWarm() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, ws := range p.warm {
+		want := min(ws.server.Warm, ws.server.PoolSize)
+		for n := len(p.conns[addr]) + p.dialing[addr]; n < want; n++ {
+			p.dialing[addr]++
+			log.Debugf("tcp pool: warm-up connection %s (total=%d/%d)", addr, n, want)
+			go func() {
+				if _, err := p.dial(ws.client, ws.server); err != nil {
+					log.Debugf("tcp pool: warm-up %s failed: %s", addr, err)
+				}
+			}()
+		}
+	}
+}
+
+// Loop forever to close idle connections. Warm-up connections are closed
+// too and replaced by fresh ones, so they are never stale when needed.
+func (p *ConnPool) reapIdleConns() {
+	for {
+		time.Sleep(poolReapInterval)
+
+		var idle []*muxConn
+		p.mu.Lock()
+		for _, conns := range p.conns {
+			for _, mc := range conns {
+				if mc.idle() {
+					idle = append(idle, mc)
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		// close takes p.mu to remove the connection from the pool
+		for _, mc := range idle {
+			mc.close(errIdle)
+		}
+		p.fillWarm()
+	}
+}
+
+// wakeup wakes every goroutine waiting in getConn. Taking the lock first
+// ensures a waiter between its check and cond.Wait doesn't miss it.
+func (p *ConnPool) wakeup() {
+	p.mu.Lock()
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// poolStats is the state of the connections to a server.
+type poolStats struct {
+	total     int
+	idle      int // without pending query
+	waiting   int
+	saturated uint64
+}
+
+// stats returns the state of the pool of each server.
+func (p *ConnPool) stats() map[string]poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]poolStats)
+	for addr, conns := range p.conns {
+		s := stats[addr]
+		s.total = len(conns)
+		for _, mc := range conns {
+			if mc.inflight() == 0 {
+				s.idle++
+			}
+		}
+		stats[addr] = s
+	}
+	for addr, n := range p.waiting {
+		s := stats[addr]
+		s.waiting = n
+		stats[addr] = s
+	}
+	for addr, n := range p.saturated {
+		s := stats[addr]
+		s.saturated = n
+		stats[addr] = s
+	}
+	return stats
+}
+
+// removeConn drops a dead connection from the pool.
+func (p *ConnPool) removeConn(mc *muxConn) {
+	p.mu.Lock()
+	conns := p.conns[mc.addr]
+	for i, c := range conns {
+		if c == mc {
+			p.conns[mc.addr] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	p.cond.Broadcast() // a slot freed up
+	p.mu.Unlock()
+}
+
+// =============================================================================
+// Multiplexed connection
+// =============================================================================
+
+// muxConn is a TCP/TLS connection shared by concurrent queries. Writes are
+// serialised; a reader goroutine dispatches each answer to the query waiting
+// for its message ID. Queries are renumbered on the wire so that clients
+// using the same ID never collide.
+type muxConn struct {
+	pool      *ConnPool
+	addr      string // server key
+	conn      *dns.Conn
+	keepAlive bool       // send the EDNS TCP keepalive option
+	padding   bool       // pad the queries (TLS only)
+	wmu       sync.Mutex // serialises writes
+
+	mu          sync.Mutex // protects the fields below
+	pending     map[uint16]chan *dns.Msg
+	nextID      uint16
+	lastUsed    time.Time
+	idleTimeout time.Duration
+	timeouts    int   // queries timed out in a row
+	err         error // set once the connection is dead
+}
+
+func newMuxConn(pool *ConnPool, serv Server, conn *dns.Conn) *muxConn {
+	mc := &muxConn{
+		pool:        pool,
+		addr:        serv.key(),
+		conn:        conn,
+		keepAlive:   serv.KeepAlive,
+		padding:     serv.Scheme == "tcp-tls" && serv.Padding,
+		pending:     make(map[uint16]chan *dns.Msg),
+		nextID:      uint16(rand.UintN(1 << 16)),
+		lastUsed:    time.Now(),
+		idleTimeout: serv.IdleTimeout,
+	}
+	go mc.readLoop()
+	return mc
+}
+
+// idle reports whether the connection has been unused for longer than its
+// idle timeout.
+func (mc *muxConn) idle() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.pending) == 0 && time.Since(mc.lastUsed) > mc.idleTimeout
+}
+
+// inflight returns the number of queries waiting for an answer.
+func (mc *muxConn) inflight() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.pending)
+}
+
+// dead reports whether the connection has been closed.
+func (mc *muxConn) dead() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.err != nil
+}
+
+// exchange sends a query and waits for its answer, at most timeout.
+// The answer carries the ID of the original query.
+func (mc *muxConn) exchange(query *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	mc.mu.Lock()
+	if mc.err != nil {
+		mc.mu.Unlock()
+		return nil, mc.err
+	}
+	for {
+		mc.nextID++
+		if _, used := mc.pending[mc.nextID]; !used {
+			break
+		}
+	}
+	id := mc.nextID
+	ch := make(chan *dns.Msg, 1)
+	mc.pending[id] = ch
+	mc.mu.Unlock()
+	defer mc.release(id)
+
+	// shallow copy: only the header ID differs on the wire, unless EDNS
+	// options are added
+	wire := *query
+	if (mc.keepAlive || mc.padding) && query.IsEdns0() != nil {
+		wire = *query.Copy()
+		opt := wire.IsEdns0()
+		if mc.keepAlive {
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		}
+		if mc.padding {
+			pad(&wire, paddingBlockSize) // last, to cover every option
+		}
+	}
+	wire.Id = id
+
+	mc.wmu.Lock()
+	mc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := mc.conn.WriteMsg(&wire)
+	mc.wmu.Unlock()
+	if err != nil {
+		mc.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			mc.mu.Lock()
+			defer mc.mu.Unlock()
+			return nil, mc.err
+		}
+		mc.handleKeepAlive(resp)
+		resp.Id = query.Id
+		return resp, nil
+	case <-timer.C:
+		mc.mu.Lock()
+		mc.timeouts++
+		wedged := mc.timeouts >= maxConnTimeouts
+		mc.mu.Unlock()
+		if wedged {
+			mc.close(errWedged)
+		}
+		return nil, fmt.Errorf("timeout waiting for %s", mc.addr)
+	}
+}
+
+// release forgets a finished query and wakes a goroutine waiting for room
+// in the pool.
+func (mc *muxConn) release(id uint16) {
+	mc.mu.Lock()
+	delete(mc.pending, id)
+	mc.lastUsed = time.Now()
+	mc.mu.Unlock()
+	mc.pool.wakeup()
+}
+
+// handleKeepAlive removes the EDNS TCP keepalive option from an answer (it
+// is hop-by-hop) and lowers the idle timeout to the one the server
+// announced, so that we close the connection before it does.
+func (mc *muxConn) handleKeepAlive(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE)
+		if !ok {
+			options = append(options, o)
+			continue
+		}
+		timeout := time.Duration(ka.Timeout)*100*time.Millisecond - poolReapInterval
+		mc.mu.Lock()
+		if timeout < mc.idleTimeout {
+			log.Debugf("tcp pool: %s announced keepalive %s", mc.addr, timeout+poolReapInterval)
+			mc.idleTimeout = max(timeout, 0)
+		}
+		mc.mu.Unlock()
+	}
+	opt.Option = options
+}
+
+// readLoop dispatches answers until the connection fails.
+func (mc *muxConn) readLoop() {
+	for {
+		resp, err := mc.conn.ReadMsg()
+		if err != nil {
+			mc.close(err)
+			return
+		}
+		mc.mu.Lock()
+		mc.timeouts = 0 // the server still answers
+		ch, ok := mc.pending[resp.Id]
+		delete(mc.pending, resp.Id)
+		mc.mu.Unlock()
+		if !ok {
+			log.Debugf("tcp pool: unexpected answer id=%d from %s", resp.Id, mc.addr)
+			continue
+		}
+		ch <- resp
+	}
+}
+
+// close marks the connection dead, fails the pending queries and removes
+// it from the pool.
+func (mc *muxConn) close(err error) {
+	mc.mu.Lock()
+	if mc.err != nil {
+		mc.mu.Unlock()
+		return
+	}
+	log.Debugf("tcp pool: closing connection %s: %s", mc.addr, err)
+	mc.err = fmt.Errorf("%w: %s", errConnClosed, err)
+	for id, ch := range mc.pending {
+		close(ch)
+		delete(mc.pending, id)
+	}
+	mc.mu.Unlock()
+
+	mc.conn.Close()
+	mc.pool.removeConn(mc)
 }
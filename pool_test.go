@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeTCPServer accepts connections on a loopback port and runs handle on
+// each of them. It returns the upstream server and the number of accepted
+// connections.
+func fakeTCPServer(t *testing.T, handle func(conn *dns.Conn)) (Server, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				handle(&dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	serv, err := parseServer("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.KeepAlive = false
+	return serv, accepted
+}
+
+// echoAnswer answers a query with an A record in 192.0.2.0/24, its last
+// byte taken from the first label of the name.
+func echoAnswer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 192.0.2.%s", r.Question[0].Name, dns.SplitDomainName(r.Question[0].Name)[0]))
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+// echoServer answers every query of a connection as soon as it is read.
+func echoServer(conn *dns.Conn) {
+	for {
+		r, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(echoAnswer(r))
+	}
+}
+
+func poolExchange(p *ConnPool, serv Server, name string, id uint16) (*dns.Msg, error) {
+	mc, err := p.getConn(serv.client(), serv, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if mc == nil {
+		return nil, fmt.Errorf("pool saturated")
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	q.Id = id
+	return mc.exchange(q, time.Second)
+}
+
+func checkEcho(t *testing.T, resp *dns.Msg, name string, id uint16) {
+	t.Helper()
+	if resp.Id != id {
+		t.Errorf("%s: id %d, want %d", name, resp.Id, id)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name {
+		t.Errorf("%s: wrong answer %v", name, resp.Answer)
+	}
+}
+
+// Queries with the same ID on the same connection are renumbered on the
+// wire, and their answers, coming back in any order, matched back.
+func TestMuxConnIDs(t *testing.T) {
+	wireIDs := make(chan uint16, 2)
+	serv, accepted := fakeTCPServer(t, func(conn *dns.Conn) {
+		var queries []*dns.Msg
+		for len(queries) < 2 {
+			r, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			wireIDs <- r.Id
+			queries = append(queries, r)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			conn.WriteMsg(echoAnswer(queries[i]))
+		}
+		echoServer(conn)
+	})
+	serv.PoolSize = 1
+	p := newConnPool()
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"1.example.", "2.example."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := poolExchange(p, serv, name, 1234)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				return
+			}
+			checkEcho(t, resp, name, 1234)
+		}()
+	}
+	wg.Wait()
+	if id1, id2 := <-wireIDs, <-wireIDs; id1 == id2 {
+		t.Errorf("both queries sent with id %d", id1)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+// Concurrent queries share the connections, never more than the pool size.
+func TestPoolConcurrentQueries(t *testing.T) {
+	serv, accepted := fakeTCPServer(t, echoServer)
+	serv.PoolSize = 2
+	p := newConnPool()
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("%d.example.", i%250)
+			resp, err := poolExchange(p, serv, name, uint16(i))
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				return
+			}
+			checkEcho(t, resp, name, uint16(i))
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n < 1 || n > 2 {
+		t.Errorf("%d connections, want 1 or 2", n)
+	}
+}
+
+// Idle connections are closed by the pool.
+func TestPoolIdleClose(t *testing.T) {
+	closed := make(chan struct{})
+	serv, _ := fakeTCPServer(t, func(conn *dns.Conn) {
+		echoServer(conn)
+		close(closed)
+	})
+	serv.IdleTimeout = 10 * time.Millisecond
+	p := newConnPool()
+
+	if _, err := poolExchange(p, serv, "1.example.", 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(3 * poolReapInterval):
+		t.Fatal("idle connection not closed")
+	}
+	if s := p.stats()[serv.key()]; s.total != 0 {
+		t.Errorf("%d connections left in the pool", s.total)
+	}
+}
+
+// A connection that stops answering is closed after maxConnTimeouts
+// queries timed out in a row.
+func TestMuxConnWedged(t *testing.T) {
+	serv, _ := fakeTCPServer(t, func(conn *dns.Conn) {
+		for {
+			if _, err := conn.ReadMsg(); err != nil {
+				return
+			}
+		}
+	})
+	p := newConnPool()
+	mc, err := p.getConn(serv.client(), serv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("1.example.", dns.TypeA)
+	for i := 1; i <= maxConnTimeouts; i++ {
+		if mc.dead() {
+			t.Fatalf("closed after %d timeouts", i-1)
+		}
+		if _, err := mc.exchange(q, 10*time.Millisecond); err == nil {
+			t.Fatal("answer from a silent server")
+		}
+	}
+	if !mc.dead() {
+		t.Fatalf("still open after %d timeouts", maxConnTimeouts)
+	}
+	if s := p.stats()[serv.key()]; s.total != 0 {
+		t.Errorf("%d connections left in the pool", s.total)
+	}
+}
+
+// A query arriving while the only connection is being dialed shares it as
+// soon as it is up, without waiting for another query to complete.
+func TestPoolDialWakeup(t *testing.T) {
+	cert := newTestCert(t, "server", false, nil)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(300 * time.Millisecond) // slow handshake
+				dc := &dns.Conn{Conn: conn}
+				var mu sync.Mutex
+				for {
+					r, err := dc.ReadMsg()
+					if err != nil {
+						return
+					}
+					if r.Question[0].Name == "1.example." {
+						continue // never answered
+					}
+					mu.Lock()
+					dc.WriteMsg(echoAnswer(r))
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	serv, err := parseServer("tls://" + ln.Addr().String() + "?insecure=true&pool=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newConnPool()
+
+	go poolExchange(p, serv, "1.example.", 1)
+	time.Sleep(100 * time.Millisecond) // while the connection is dialed
+	start := time.Now()
+	resp, err := poolExchange(p, serv, "2.example.", 2)
+	if err != nil {
+		t.Fatalf("waiting query: %s after %s", err, time.Since(start).Round(time.Millisecond))
+	}
+	checkEcho(t, resp, "2.example.", 2)
+	// the dial ends 200ms after, the wait for room 1s after
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("waiting query answered after %s", elapsed.Round(time.Millisecond))
+	}
+}
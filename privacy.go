@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// =============================================================================
+// Privacy of the upstream queries
+// =============================================================================
+
+// upstreamQuery prepares the query sent to a server. The EDNS options of the
+// client that are only meant for us (cookie, padding, keepalive) are
+// removed, and, for servers with 0x20 on, UDP query names get a random
+// case, harder to guess for a spoofer. Every query advertises the same EDNS
+// buffer size, whatever the client asked for: bigger answers come over TCP
+// (no IP fragmentation), and clients with a smaller buffer get them
+// truncated by us.
+func upstreamQuery(serv Server, r *dns.Msg) *dns.Msg {
+	query := r.Copy()
+	removeOptions(query, dns.EDNS0COOKIE, dns.EDNS0PADDING, dns.EDNS0TCPKEEPALIVE)
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetUDPSize(ednsUDPSize)
+	} else {
+		query.SetEdns0(ednsUDPSize, false)
+	}
+	if serv.Scheme == "udp" && serv.RandomCase {
+		query.Question[0].Name = randomCase(query.Question[0].Name)
+	}
+	return query
+}
+
+// upstreamResponse checks and cleans up the answer of a server to query.
+// With 0x20, the query name must come back with the case it was sent with;
+// the case of the client is then restored. The padding, and the EDNS record
+// the client didn't ask for, are removed, as well as the cookie of the server.
+func upstreamResponse(serv Server, query, resp, r *dns.Msg) error {
+	if serv.Scheme == "udp" && serv.RandomCase {
+		sent, asked := query.Question[0].Name, r.Question[0].Name
+		if len(resp.Question) == 0 || resp.Question[0].Name != sent {
+			return errors.New("query name case mismatch (0x20), answer dropped")
+		}
+		resp.Question[0].Name = asked
+		for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range section {
+				if rr.Header().Name == sent {
+					rr.Header().Name = asked
+				}
+			}
+		}
+	}
+	removeOptions(resp, dns.EDNS0PADDING, dns.EDNS0COOKIE)
+	if r.IsEdns0() == nil {
+		resp.Extra = removeType(resp.Extra, dns.TypeOPT, 0)
+	}
+	return nil
+}
+
+// randomCase flips the case of the letters of a name at random.
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.IntN(2) == 0 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+// pad adds a padding option to the EDNS record of a message, so that its
+// length is a multiple of block (RFC 7830, RFC 8467).
+func pad(m *dns.Msg, block int) {
+	padding := &dns.EDNS0_PADDING{}
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, padding)
+	if n := m.Len() % block; n != 0 {
+		padding.Padding = make([]byte, block-n)
+	}
+}
+
+// removeOptions removes the EDNS options with the given codes.
+func removeOptions(m *dns.Msg, codes ...uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		return slices.Contains(codes, o.Option())
+	})
+}
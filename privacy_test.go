@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomCase(t *testing.T) {
+	same := func(sent string) string { return sent }
+	swapped := func(sent string) string {
+		return strings.Map(func(c rune) rune {
+			if unicode.IsUpper(c) {
+				return unicode.ToLower(c)
+			}
+			return unicode.ToUpper(c)
+		}, sent)
+	}
+	tests := []struct {
+		url  string
+		echo func(sent string) string
+		ok   bool
+	}{
+		{"udp://9.9.9.9", same, true},
+		{"udp://9.9.9.9", swapped, true},
+		{"udp://9.9.9.9?0x20=true", same, true},
+		{"udp://9.9.9.9?0x20=true", swapped, false},
+		{"tcp://9.9.9.9?0x20=true", swapped, true},
+	}
+	for _, tt := range tests {
+		serv, err := parseServer(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.com.", dns.TypeA)
+		query := upstreamQuery(serv, r)
+		sent := query.Question[0].Name
+		if dns.CanonicalName(sent) != r.Question[0].Name || (!serv.RandomCase && sent != r.Question[0].Name) {
+			t.Errorf("%s: name sent as %s", tt.url, sent)
+		}
+
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Question[0].Name = tt.echo(sent)
+		rr, _ := dns.NewRR(resp.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+		err = upstreamResponse(serv, query, resp, r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.url, err, tt.ok)
+		}
+		if err == nil && serv.Scheme == "udp" && serv.RandomCase && (resp.Question[0].Name != r.Question[0].Name ||
+			resp.Answer[0].Header().Name != r.Question[0].Name) {
+			t.Errorf("%s: client case not restored: %s", tt.url, resp.Question[0].Name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// =============================================================================
+// Query log
+// =============================================================================
+
+// sources of the answers, besides the upstream servers
+const (
+	sourceCache     = "cache"
+	sourceLocal     = "local"     // hosts.txt
+	sourceRecursion = "recursion" // resolved from the root servers
+	sourceNSEC      = "nsec"      // synthesized from cached NSEC records (RFC 8198)
+)
+
+// queryRecord is a line of the query log.
+type queryRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Zone      string    `json:"zone"`
+	Source    string    `json:"source,omitempty"`
+	LatencyMs float64   `json:"latencyMs"`
+}
+
+// QueryLog writes a JSON line per client query to a sink: stdout, syslog or
+// a file rotated by size. Records are written by a goroutine, so that a slow
+// sink never delays the answers: when it lags behind, records are dropped.
+type QueryLog struct {
+	sample   float64  // fraction of the queries logged
+	excluded []string // domains not logged
+	records  chan queryRecord
+	stop     chan struct{} // closed at exit
+	done     chan struct{} // closed once the records are written
+	dropped  int
+	mu       sync.Mutex // protects dropped
+}
+
+// queryLog is nil unless -queryLog is set.
+var queryLog *QueryLog
+
+// newQueryLog opens the sink: "stdout", "syslog" or a file name.
+func newQueryLog(sink string, maxSize int64, backups int, sample float64, exclude string) (*QueryLog, error) {
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("QUERY LOG SAMPLE ERROR: %g", sample)
+	}
+	var w io.Writer
+	var closer io.Closer // nil for stdout
+	switch sink {
+	case "stdout":
+		w = os.Stdout
+	case "syslog":
+		sw, err := newSyslogWriter()
+		if err != nil {
+			return nil, err
+		}
+		w = sw
+		closer, _ = sw.(io.Closer)
+	default:
+		fw, err := newRotatingFile(sink, maxSize, backups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = fw, fw
+	}
+
+	ql := &QueryLog{
+		sample:  sample,
+		records: make(chan queryRecord, queryLogBuffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, domain := range strings.Split(exclude, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			ql.excluded = append(ql.excluded, dns.CanonicalName(domain))
+		}
+	}
+	go ql.run(w, closer)
+	log.Infof("Query log to %s", sink)
+	return ql, nil
+}
+
+// log records a client query, once answered.
+func (ql *QueryLog) log(r *dns.Msg, w *answerWriter, zone, source string, elapsed time.Duration) {
+	if ql == nil {
+		return
+	}
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	for _, domain := range ql.excluded {
+		if dns.IsSubDomain(domain, name) {
+			return
+		}
+	}
+	if ql.sample < 1 && rand.Float64() >= ql.sample {
+		return
+	}
+
+	record := queryRecord{
+		Time:      time.Now(),
+		Transport: w.transport(),
+		Name:      name,
+		Type:      dns.TypeToString[q.Qtype],
+		Rcode:     w.rcodeName(),
+		Zone:      zone,
+		Source:    source,
+		LatencyMs: float64(elapsed.Microseconds()) / 1000,
+	}
+	if ip := remoteIP(w.RemoteAddr()); ip != nil {
+		record.Client = ip.String()
+	}
+
+	select {
+	case ql.records <- record:
+	default:
+		ql.mu.Lock()
+		ql.dropped++
+		ql.mu.Unlock()
+	}
+}
+
+// close writes the queued records and closes the sink, at exit.
+func (ql *QueryLog) close() {
+	if ql == nil {
+		return
+	}
+	close(ql.stop)
+	select {
+	case <-ql.done:
+	case <-time.After(queryLogCloseTimeout):
+		log.Warning("Query log: records not written in time")
+	}
+}
+
+// run writes the records to the sink, until stopped and the queued records
+// written.
+func (ql *QueryLog) run(w io.Writer, closer io.Closer) {
+	defer func() {
+		if closer != nil {
+			if err := closer.Close(); err != nil {
+				log.Warningf("Error closing query log: %s", err)
+			}
+		}
+		close(ql.done)
+	}()
+	for {
+		var record queryRecord
+		select {
+		case record = <-ql.records:
+		case <-ql.stop:
+			select {
+			case record = <-ql.records:
+			default:
+				return
+			}
+		}
+		ql.mu.Lock()
+		dropped := ql.dropped
+		ql.dropped = 0
+		ql.mu.Unlock()
+		if dropped > 0 {
+			log.Warningf("Query log: %d records dropped", dropped)
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			log.Warningf("Error writing query log: %s", err)
+		}
+	}
+}
+
+// =============================================================================
+// Rotating file
+// =============================================================================
+
+// rotatingFile is a file renamed to file.1 once it reaches its maximum size,
+// file.1 becoming file.2 and so on, up to the number of backups kept.
+type rotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func newRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	if maxSize <= 0 || backups < 0 {
+		return nil, fmt.Errorf("QUERY LOG ROTATION ERROR: %d bytes, %d backups", maxSize, backups)
+	}
+	rf := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close flushes the file to disk and closes it.
+func (rf *rotatingFile) Close() error {
+	err := rf.file.Sync()
+	if cerr := rf.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	if rf.backups == 0 {
+		os.Remove(rf.name)
+	}
+	for i := rf.backups; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", rf.name, i)
+		newer := rf.name
+		if i > 1 {
+			newer = fmt.Sprintf("%s.%d", rf.name, i-1)
+		}
+		os.Rename(newer, older) // missing backups are fine
+	}
+	return rf.open()
+}
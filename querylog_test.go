@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// readLines returns the lines of a file, nil if it doesn't exist.
+func readLines(t *testing.T, filename string) []string {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(b))
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups int
+		files   [][]string // contents of the file, then of its backups
+	}{
+		// 2 lines of 40 bytes fit in 100 bytes: 7 lines rotate 3 times
+		{"backups", 2, [][]string{{"line7"}, {"line5", "line6"}, {"line3", "line4"}, nil}},
+		{"no backup", 0, [][]string{{"line7"}, nil}},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "queries.log")
+		rf, err := newRotatingFile(name, 100, tt.backups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 7 {
+			line := fmt.Sprintf("%-39s\n", fmt.Sprintf("line%d", i+1))
+			if _, err := rf.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range tt.files {
+			filename := name
+			if i > 0 {
+				filename = fmt.Sprintf("%s.%d", name, i)
+			}
+			if got := readLines(t, filename); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("%s: %s holds %v, want %v", tt.name, filepath.Base(filename), got, want)
+			}
+		}
+	}
+
+	// the size of an existing file counts
+	name := filepath.Join(t.TempDir(), "queries.log")
+	if err := os.WriteFile(name, []byte(strings.Repeat("x", 98)+"\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := newRotatingFile(name, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("line1\n"))
+	rf.Close()
+	if got := readLines(t, name); len(got) != 1 || got[0] != "line1" {
+		t.Errorf("after reopening, file holds %v, want [line1]", got)
+	}
+
+	for _, tt := range []struct {
+		maxSize int64
+		backups int
+	}{{0, 1}, {100, -1}} {
+		if _, err := newRotatingFile(name, tt.maxSize, tt.backups); err == nil {
+			t.Errorf("%d bytes, %d backups accepted", tt.maxSize, tt.backups)
+		}
+	}
+}
+
+// logQueries logs an A query for each name, then closes the query log and
+// returns the names logged.
+func logQueries(t *testing.T, sample float64, exclude string, names ...string) []string {
+	t.Helper()
+	log.SetLevel(log.WarnLevel)
+	filename := filepath.Join(t.TempDir(), "queries.log")
+	ql, err := newQueryLog(filename, 1<<20, 1, sample, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &answerWriter{ResponseWriter: &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}}
+	for _, name := range names {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		ql.log(r, w, "default", sourceCache, 0)
+	}
+	ql.close()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var logged []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record queryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%q: %s", scanner.Text(), err)
+		}
+		logged = append(logged, record.Name)
+	}
+	return logged
+}
+
+func TestQueryLogExclude(t *testing.T) {
+	logged := logQueries(t, 1, "Example.org, lan",
+		"www.example.com.", "www.example.org.", "example.org.", "notexample.org.", "printer.lan.", "WWW.Example.COM.")
+	want := "www.example.com. notexample.org. www.example.com."
+	if got := strings.Join(logged, " "); got != want {
+		t.Errorf("logged %s, want %s", got, want)
+	}
+}
+
+// Every record queued is written once the query log is closed.
+func TestQueryLogClose(t *testing.T) {
+	names := make([]string, queryLogBuffer/2)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d.example.", i)
+	}
+	if logged := logQueries(t, 1, "", names...); len(logged) != len(names) {
+		t.Errorf("%d records written, want %d", len(logged), len(names))
+	}
+}
+
+func TestQueryLogSample(t *testing.T) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "www.example."
+	}
+	if logged := logQueries(t, 0.5, "", names...); len(logged) < 350 || len(logged) > 650 {
+		t.Errorf("%d records of 1000 logged with a sample of 0.5", len(logged))
+	}
+	for _, sample := range []float64{0, -1, 1.5} {
+		if _, err := newQueryLog("stdout", 1, 1, sample, ""); err == nil {
+			t.Errorf("sample %g accepted", sample)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recursor resolves names by itself for the zones with recursive: true,
+// following the referrals from the root servers down to the authoritative
+// servers of the name. Query names are minimised (RFC 9156): each server
+// only sees the labels it needs to answer with a referral. The name servers
+// of the zones met on the way are cached. Only authoritative answers and
+// referrals are accepted.
+type Recursor struct {
+	roots       []string // host:port
+	port        string   // of the name servers met in referrals
+	mu          sync.Mutex
+	delegations map[string]delegation // by zone
+}
+
+type delegation struct {
+	servers []string // host:port
+	expiry  time.Time
+}
+
+// recursor is shared by every recursive zone.
+var recursor = &Recursor{port: "53", delegations: map[string]delegation{}}
+
+// setRootHints sets the root servers from a comma separated list of IPs,
+// with an optional port.
+func (rc *Recursor) setRootHints(list string) error {
+	roots, err := splitAddrs(list)
+	if err != nil {
+		return fmt.Errorf("ROOT HINT ERROR: %s", err)
+	}
+	if len(roots) == 0 {
+		return errors.New("ROOT HINT ERROR: no root server")
+	}
+	rc.roots = roots
+	return nil
+}
+
+// resolve answers a client request by iterating from the closest known
+// zone. It returns nil when no server could answer.
+func (rc *Recursor) resolve(r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	do := r.IsEdns0() != nil && r.IsEdns0().Do()
+	resp, err := rc.iterate(dns.CanonicalName(q.Name), q.Qtype, do, 0)
+	if err != nil {
+		log.Debugf("Recursion: %s %s: %s", q.Name, dns.TypeToString[q.Qtype], err)
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	m.CheckingDisabled = r.CheckingDisabled
+	m.Rcode = resp.Rcode
+	m.Answer = resp.Answer
+	m.Ns = resp.Ns
+	if r.IsEdns0() != nil {
+		m.SetEdns0(ednsUDPSize, do)
+	}
+	return m
+}
+
+// iterate resolves name, following referrals then the CNAME chain.
+func (rc *Recursor) iterate(name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, errors.New("too many nested resolutions")
+	}
+	zone, servers := rc.closest(name, qtype)
+	known := zone // deepest name known to exist
+	minimise := true
+
+	for range maxReferrals {
+		qname, qt := name, qtype
+		if minimise && known != name {
+			qname = childName(known, name)
+			if qname != name {
+				qt = dns.TypeA
+			}
+		}
+		resp, err := rc.query(servers, zone, qname, qt, do)
+		if err != nil {
+			return nil, err
+		}
+
+		if child, ns, ttl := referral(resp, zone, qname); child != "" {
+			servers, err = rc.nameServers(zone, ns, resp.Extra, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", child, err)
+			}
+			rc.store(child, servers, ttl)
+			log.Debugf("Recursion: %s delegated to %v", child, servers)
+			zone, known = child, child
+			continue
+		}
+
+		if qname != name {
+			if resp.Rcode != dns.RcodeSuccess {
+				// some servers get empty non-terminals wrong, ask the full name
+				minimise = false
+			} else {
+				known = qname
+			}
+			continue
+		}
+
+		// keep the records the servers are authoritative for, and resolve
+		// the rest of the CNAME chain
+		resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool {
+			return !dns.IsSubDomain(zone, rr.Header().Name)
+		})
+		if target := cnameTarget(resp.Answer, name, qtype); target != "" {
+			next, err := rc.iterate(target, qtype, do, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			resp.Answer = append(resp.Answer, next.Answer...)
+			resp.Ns = next.Ns
+			resp.Rcode = next.Rcode
+		}
+		return resp, nil
+	}
+	return nil, errors.New("too many referrals")
+}
+
+// closest returns the closest zone enclosing name whose servers are known.
+// DS records live in the parent zone.
+func (rc *Recursor) closest(name string, qtype uint16) (string, []string) {
+	zone := name
+	if qtype == dns.TypeDS {
+		zone = parentName(name)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	for ; zone != "."; zone = parentName(zone) {
+		if d, ok := rc.delegations[zone]; ok && d.expiry.After(now) {
+			return zone, d.servers
+		}
+	}
+	return ".", rc.roots
+}
+
+func (rc *Recursor) store(zone string, servers []string, ttl uint32) {
+	ttl = min(max(ttl, delegationMinTTL), delegationMaxTTL)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.delegations[zone] = delegation{
+		servers: servers,
+		expiry:  time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// prune removes the expired delegations.
+func (rc *Recursor) prune() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	for zone, d := range rc.delegations {
+		if d.expiry.Before(now) {
+			delete(rc.delegations, zone)
+		}
+	}
+}
+
+// query asks the servers of a zone, in random order, IPv4 first. Truncated
+// UDP answers are retried over TCP. Answers without the AA bit, other than
+// referrals, come from a lame server or its cache: the next one is asked.
+func (rc *Recursor) query(servers []string, zone, name string, qtype uint16, do bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(ednsUDPSize, do)
+
+	servers = slices.Clone(servers)
+	rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+	slices.SortStableFunc(servers, func(a, b string) int {
+		return strings.Count(a, ":") - strings.Count(b, ":")
+	})
+
+	for _, server := range servers {
+		c := &dns.Client{Timeout: serverDefaults.Timeout}
+		resp, _, err := c.Exchange(m, server)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.Exchange(m, server)
+		}
+		if err != nil {
+			log.Debugf("Recursion: %s: %s", server, err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			log.Debugf("Recursion: %s: %s for %s", server, dns.RcodeToString[resp.Rcode], name)
+			continue
+		}
+		if child, _, _ := referral(resp, zone, name); !resp.Authoritative && child == "" {
+			log.Debugf("Recursion: %s: not authoritative for %s", server, name)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no answer for %s %s", name, dns.TypeToString[qtype])
+}
+
+// nameServers returns the addresses of the name servers of a delegation:
+// the glue records given by the servers of zone when they are authoritative
+// for them, otherwise the resolved names, IPv4 or IPv6 only.
+func (rc *Recursor) nameServers(zone string, ns []string, extra []dns.RR, depth int) ([]string, error) {
+	var servers []string
+	for _, rr := range extra {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !slices.Contains(ns, owner) || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			servers = append(servers, net.JoinHostPort(rr.A.String(), rc.port))
+		case *dns.AAAA:
+			servers = append(servers, net.JoinHostPort(rr.AAAA.String(), rc.port))
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	for _, name := range ns {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, err := rc.iterate(name, qtype, false, depth+1)
+			if err != nil {
+				log.Debugf("Recursion: name server %s: %s", name, err)
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					servers = append(servers, net.JoinHostPort(rr.A.String(), rc.port))
+				case *dns.AAAA:
+					servers = append(servers, net.JoinHostPort(rr.AAAA.String(), rc.port))
+				}
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, errors.New("no reachable name server")
+}
+
+// referral returns the delegated zone, its name servers and their TTL when
+// resp is a referral from zone towards qname.
+func referral(resp *dns.Msg, zone, qname string) (string, []string, uint32) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		return "", nil, 0
+	}
+	var child string
+	var ns []string
+	var ttl uint32
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			return "", nil, 0 // negative answer
+		case *dns.NS:
+			owner := dns.CanonicalName(rr.Hdr.Name)
+			if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+				continue
+			}
+			if child != "" && owner != child {
+				continue
+			}
+			child = owner
+			ns = append(ns, dns.CanonicalName(rr.Ns))
+			if len(ns) == 1 || rr.Hdr.Ttl < ttl {
+				ttl = rr.Hdr.Ttl
+			}
+		}
+	}
+	return child, ns, ttl
+}
+
+// cnameTarget follows the CNAME chain of an answer from name, and returns
+// the target left to resolve, if any.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			if dns.CanonicalName(rr.Header().Name) != name {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Target) == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// childName returns the ancestor of name one label below zone.
+func childName(zone, name string) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(zone)-1:], "."))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testAuthority is the authoritative server of unsigned zones. It refers
+// the names below the delegations of its zones, with the glue it has, and
+// answers the others. A lame server answers without the AA bit, wrongly.
+type testAuthority struct {
+	zones   []*testZone
+	lame    bool
+	mu      sync.Mutex
+	queries []string
+}
+
+func (a *testAuthority) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	a.mu.Lock()
+	a.queries = append(a.queries, name)
+	a.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	var zone *testZone
+	for _, z := range a.zones {
+		if dns.IsSubDomain(z.name, name) && (q.Qtype != dns.TypeDS || name != z.name) {
+			zone = z
+		}
+	}
+	if zone == nil {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	// referral to the delegation holding the name
+	cut := ""
+	for _, rr := range zone.rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if _, ok := rr.(*dns.NS); ok && owner != zone.name && dns.IsSubDomain(owner, name) &&
+			(q.Qtype != dns.TypeDS || owner != name) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		for _, rr := range zone.rrs {
+			if ns, ok := rr.(*dns.NS); ok && dns.CanonicalName(ns.Hdr.Name) == cut {
+				m.Ns = append(m.Ns, ns)
+				for _, glue := range zone.rrs {
+					t := glue.Header().Rrtype
+					if (t == dns.TypeA || t == dns.TypeAAAA) && glue.Header().Name == ns.Ns && dns.IsSubDomain(cut, ns.Ns) {
+						m.Extra = append(m.Extra, glue)
+					}
+				}
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	if a.lame {
+		rr, _ := dns.NewRR(name + " 300 IN A 192.0.2.66")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+		return
+	}
+	m.Authoritative = true
+	exists := false
+	for _, rr := range zone.rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+		if owner == name && rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, zone.rrs[0]) // SOA
+	}
+	w.WriteMsg(m)
+}
+
+// newTestRecursor serves a hierarchy of authoritative servers, on the same
+// port of several loopback addresses, and returns a recursor starting from
+// its root server:
+//
+//	.              127.0.0.1
+//	test.          127.0.0.2
+//	glue6.test.    ::1, IPv6 only glue
+//	v6.test.       ::1, name server out of the zone, IPv6 only
+//	lame.test.     127.0.0.3, lame, and 127.0.0.4
+func newTestRecursor(t *testing.T) (*Recursor, *testAuthority, *testAuthority) {
+	t.Helper()
+	root := newTestZone(t, ".", false,
+		"test. 300 IN NS ns1.test.",
+		"ns1.test. 300 IN A 127.0.0.2")
+	test := newTestZone(t, "test.", false,
+		"www.test. 300 IN A 192.0.2.1",
+		"glue6.test. 300 IN NS ns.glue6.test.",
+		"ns.glue6.test. 300 IN AAAA ::1",
+		"v6.test. 300 IN NS ns.v6host.test.",
+		"ns.v6host.test. 300 IN AAAA ::1",
+		"lame.test. 300 IN NS a.lame.test.",
+		"lame.test. 300 IN NS b.lame.test.",
+		"a.lame.test. 300 IN A 127.0.0.3",
+		"b.lame.test. 300 IN A 127.0.0.4")
+	glue6 := newTestZone(t, "glue6.test.", false, "www.glue6.test. 300 IN A 192.0.2.6")
+	v6 := newTestZone(t, "v6.test.", false, "www.v6.test. 300 IN A 192.0.2.7")
+	lame := newTestZone(t, "lame.test.", false, "www.lame.test. 300 IN A 192.0.2.8")
+
+	rootServer := &testAuthority{zones: []*testZone{root}}
+	tldServer := &testAuthority{zones: []*testZone{test}}
+	rootAddr := serveTestUpstream(t, rootServer, "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(rootAddr)
+	for ip, server := range map[string]*testAuthority{
+		"127.0.0.2": tldServer,
+		"::1":       {zones: []*testZone{glue6, v6}},
+		"127.0.0.3": {zones: []*testZone{lame}, lame: true},
+		"127.0.0.4": {zones: []*testZone{lame}},
+	} {
+		serveTestUpstream(t, server, net.JoinHostPort(ip, port))
+	}
+
+	rc := &Recursor{port: port, delegations: map[string]delegation{}}
+	if err := rc.setRootHints(rootAddr); err != nil {
+		t.Fatal(err)
+	}
+	return rc, rootServer, tldServer
+}
+
+func TestRecursorResolve(t *testing.T) {
+	rc, rootServer, tldServer := newTestRecursor(t)
+	tests := []struct {
+		name   string
+		rcode  int
+		answer string
+	}{
+		{"www.test.", dns.RcodeSuccess, "192.0.2.1"},
+		{"nx.test.", dns.RcodeNameError, ""},
+		{"www.glue6.test.", dns.RcodeSuccess, "192.0.2.6"},
+		{"www.v6.test.", dns.RcodeSuccess, "192.0.2.7"},
+		{"nx.v6.test.", dns.RcodeNameError, ""},
+	}
+	// the lame server, asked first half of the time, is skipped
+	for range 10 {
+		tests = append(tests, struct {
+			name   string
+			rcode  int
+			answer string
+		}{"www.lame.test.", dns.RcodeSuccess, "192.0.2.8"})
+	}
+
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		resp := rc.resolve(r)
+		if resp == nil {
+			t.Errorf("%s: no answer", tt.name)
+			continue
+		}
+		answer := ""
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				answer = a.A.String()
+			}
+		}
+		if resp.Rcode != tt.rcode || answer != tt.answer {
+			t.Errorf("%s: got %s %q, want %s %q", tt.name,
+				dns.RcodeToString[resp.Rcode], answer, dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+
+	// QNAME minimisation: each server only sees one label more than its zone
+	for _, server := range []*testAuthority{rootServer, tldServer} {
+		zone := server.zones[0].name
+		server.mu.Lock()
+		queries := server.queries
+		server.mu.Unlock()
+		for _, name := range queries {
+			if dns.CountLabel(name) > dns.CountLabel(zone)+1 && name != "ns.v6host.test." {
+				t.Errorf("%s asked for %s", zone, name)
+			}
+		}
+	}
+}
+
+func TestReferral(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	tests := []struct {
+		name  string
+		ns    []dns.RR
+		zone  string
+		qname string
+		child string
+	}{
+		{"referral", []dns.RR{rr("test. 300 IN NS a.test."), rr("test. 300 IN NS b.test.")}, ".", "www.test.", "test."},
+		{"negative answer", []dns.RR{rr("test. 300 IN SOA a.test. h.test. 1 1 1 1 1")}, "test.", "nx.test.", ""},
+		{"upward referral", []dns.RR{rr(". 300 IN NS a.root.")}, "test.", "www.test.", ""},
+		{"sideways referral", []dns.RR{rr("other. 300 IN NS a.other.")}, ".", "www.test.", ""},
+	}
+	for _, tt := range tests {
+		resp := new(dns.Msg)
+		resp.Ns = tt.ns
+		if child, _, _ := referral(resp, tt.zone, tt.qname); child != tt.child {
+			t.Errorf("%s: got %q, want %q", tt.name, child, tt.child)
+		}
+	}
+}
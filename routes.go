@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// =============================================================================
+// Longest-match routing
+// =============================================================================
+
+// routes finds the zone of the most specific network or domain, whatever
+// the order of the zones in forward.yaml (-longestMatch). Networks are kept
+// in a binary radix tree per address family, domains in a trie of labels,
+// so that lookups don't depend on the number of zones. A zone without
+// servers gives way to the next less specific one.
+type routes struct {
+	ipv4    ipTrie
+	ipv6    ipTrie
+	domains domainTrie
+}
+
+func newRoutes(zones []Forward) *routes {
+	rt := new(routes)
+	for i := range zones {
+		zone := &zones[i]
+		for _, ipNet := range zone.Networks {
+			// IPv4-mapped networks hold IPv4 addresses, as with ipNet.Contains
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				rt.ipv4.insert(ip4, maskSize(ipNet), zone)
+			} else {
+				rt.ipv6.insert(ipNet.IP, maskSize(ipNet), zone)
+			}
+		}
+		for _, domain := range zone.Domains {
+			rt.domains.insert(domain, zone)
+		}
+	}
+	return rt
+}
+
+// findZoneByIP returns the zone of the most specific network holding ip.
+func (rt *routes) findZoneByIP(ip net.IP) *Forward {
+	if ip4 := ip.To4(); ip4 != nil {
+		return rt.ipv4.lookup(ip4)
+	}
+	return rt.ipv6.lookup(ip)
+}
+
+// findZoneByFQDN returns the zone of the most specific domain holding fqdn.
+func (rt *routes) findZoneByFQDN(fqdn string) *Forward {
+	return rt.domains.lookup(fqdn)
+}
+
+// ipTrie is a node of a binary radix tree: bit n of an address selects the
+// child at depth n. A node holds the zone of the network ending there.
+type ipTrie struct {
+	children [2]*ipTrie
+	zone     *Forward
+}
+
+// insert adds a network. A network listed twice stays in its first zone.
+func (t *ipTrie) insert(ip net.IP, ones int, zone *Forward) {
+	node := t
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(ipTrie)
+		}
+		node = node.children[bit]
+	}
+	if node.zone == nil {
+		node.zone = zone
+	}
+}
+
+// lookup returns the zone of the longest network holding ip (see longest).
+func (t *ipTrie) lookup(ip net.IP) *Forward {
+	var best longest
+	best.add(t.zone)
+	for i, node := 0, t; i < len(ip)*8; i++ {
+		if node = node.children[ip[i/8]>>(7-i%8)&1]; node == nil {
+			break
+		}
+		best.add(node.zone)
+	}
+	return best.zone()
+}
+
+// longest keeps the zones met along a path of a trie, from the least
+// specific.
+type longest struct {
+	usable, last *Forward
+}
+
+func (l *longest) add(zone *Forward) {
+	if zone == nil {
+		return
+	}
+	l.last = zone
+	if zone.usable() {
+		l.usable = zone
+	}
+}
+
+// zone returns the most specific zone with servers, else the most specific
+// zone, for which the default servers answer.
+func (l *longest) zone() *Forward {
+	if l.usable != nil {
+		return l.usable
+	}
+	return l.last
+}
+
+// domainTrie is a node of a trie of labels, from the top-level domain. A
+// node holds the zone of the domain ending there.
+type domainTrie struct {
+	children map[string]*domainTrie
+	zone     *Forward
+}
+
+// insert adds a domain. A domain listed twice stays in its first zone.
+func (t *domainTrie) insert(domain string, zone *Forward) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = map[string]*domainTrie{}
+			}
+			child = new(domainTrie)
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.zone == nil {
+		node.zone = zone
+	}
+}
+
+// lookup returns the zone of the longest domain holding fqdn (see longest).
+func (t *domainTrie) lookup(fqdn string) *Forward {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	node := t
+	var best longest
+	for name != "" {
+		label := name
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			label, name = name[i+1:], name[:i]
+		} else {
+			name = ""
+		}
+		if node = node.children[label]; node == nil {
+			break
+		}
+		best.add(node.zone)
+	}
+	return best.zone()
+}
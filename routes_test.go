@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// routingConfig lists overlapping zones, the more specific ones in the
+// middle, so that first and longest match differ.
+const routingConfig = `
+- name: lab
+  networks: [10.1.2.0/24]
+  domains: [lab.office.example.com]
+- name: lan
+  networks: [10.0.0.0/8]
+  domains: [example.com]
+  servers: [udp://192.0.2.1]
+- name: office
+  networks: [10.1.0.0/16]
+  domains: [Office.Example.COM.]
+  servers: [udp://192.0.2.2]
+- name: mapped
+  networks: ["::ffff:172.16.0.0/108"]
+  servers: [udp://192.0.2.3]
+- name: v6
+  networks: [2001:db8::/32, 2001:db8:1::/48]
+  servers: [udp://192.0.2.4]
+- name: v6lab
+  networks: [2001:db8:1:2::/64]
+- servers: [udp://192.0.2.9]
+`
+
+func newRoutingForwarder(t *testing.T, longestMatch bool) *Forwarder {
+	t.Helper()
+	var configs []ForwardConfig
+	if err := yaml.Unmarshal([]byte(routingConfig), &configs); err != nil {
+		t.Fatal(err)
+	}
+	fw, problems := buildZones(configs, longestMatch)
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	return fw
+}
+
+func TestRoute(t *testing.T) {
+	reverse := func(ip string) string {
+		name, _ := dns.ReverseAddr(ip)
+		return name
+	}
+	tests := []struct {
+		name    string
+		first   string
+		longest string
+	}{
+		{"www.example.com.", "lan", "lan"},
+		{"WWW.Example.COM.", "lan", "lan"},
+		{"example.com.", "lan", "lan"},
+		{"office.example.com.", "lan", "office"},
+		{"Host.OFFICE.example.com.", "lan", "office"},
+		{"x.lab.office.example.com.", defaultZoneName, "office"},
+		{"lab.office.example.com.", defaultZoneName, "office"},
+		{"notexample.com.", defaultZoneName, defaultZoneName},
+		{"example.org.", defaultZoneName, defaultZoneName},
+		{reverse("10.9.9.9"), "lan", "lan"},
+		{reverse("10.1.9.9"), "lan", "office"},
+		{reverse("10.1.2.3"), defaultZoneName, "office"},
+		{reverse("11.0.0.1"), defaultZoneName, defaultZoneName},
+		{reverse("172.16.5.5"), "mapped", "mapped"},
+		{reverse("::ffff:172.31.5.5"), "mapped", "mapped"},
+		{reverse("172.32.0.1"), defaultZoneName, defaultZoneName},
+		{reverse("2001:db8::1"), "v6", "v6"},
+		{reverse("2001:db8:1:2::1"), "v6", "v6"},
+		{reverse("2001:db9::1"), defaultZoneName, defaultZoneName},
+	}
+	first, longest := newRoutingForwarder(t, false), newRoutingForwarder(t, true)
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		if zone := first.route(r); zone.Name != tt.first {
+			t.Errorf("%s: first match %s, want %s", tt.name, zone.Name, tt.first)
+		}
+		if zone := longest.route(r); zone.Name != tt.longest {
+			t.Errorf("%s: longest match %s, want %s", tt.name, zone.Name, tt.longest)
+		}
+	}
+}
+
+// The zone without servers is still the one found, for which the default
+// servers answer.
+func TestRoutesWithoutServers(t *testing.T) {
+	zones := []Forward{{Name: "lab", Domains: []string{"lab.test"}}}
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	zones = append(zones, Forward{Name: "lan", Networks: []*net.IPNet{ipNet}})
+	rt := newRoutes(zones)
+	if zone := rt.findZoneByFQDN("www.lab.test"); zone == nil || zone.Name != "lab" {
+		t.Errorf("www.lab.test: got %v, want lab", zone)
+	}
+	if zone := rt.findZoneByIP(net.ParseIP("10.1.2.3")); zone == nil || zone.Name != "lan" {
+		t.Errorf("10.1.2.3: got %v, want lan", zone)
+	}
+	if zone := rt.findZoneByFQDN("test"); zone != nil {
+		t.Errorf("test: got %s, want none", zone.Name)
+	}
+}
+
+func TestMaskSize(t *testing.T) {
+	tests := []struct {
+		cidr string
+		size int
+	}{
+		{"10.0.0.0/8", 8},
+		{"0.0.0.0/0", 0},
+		{"::ffff:10.0.0.0/104", 8},
+		{"::ffff:10.1.2.3/128", 32},
+		{"2001:db8::/32", 32},
+		{"::/0", 0},
+	}
+	for _, tt := range tests {
+		_, ipNet, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := maskSize(ipNet); size != tt.size {
+			t.Errorf("%s: got %d, want %d", tt.cidr, size, tt.size)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server is an upstream DNS server, parsed from a URL like
+// tls://9.9.9.9:853?idle=20s#dns.quad9.net. The address may also be a host
+// name (tls://dns.quad9.net), which is then resolved by the bootstrap
+// servers and used as TLS server name.
+type Server struct {
+	URL    string // as configured
+	Scheme string
+	Addr   string
+	Port   int
+
+	Timeout   time.Duration // dial, write and read timeout
+	Source    net.IP        // source address of outgoing queries
+	Interface string        // network interface of outgoing queries
+	Proxy     *url.URL      // SOCKS5 or HTTP CONNECT proxy (TCP/TLS only)
+
+	// Privacy options
+	Padding    bool // pad TLS queries to a block length (RFC 8467)
+	RandomCase bool // randomise the case of UDP query names (0x20)
+	Cookie     bool // send DNS cookies to UDP servers (RFC 7873)
+
+	// TCP/TLS connection pool options
+	PoolSize    int           // maximum number of connections
+	PoolWait    time.Duration // wait for room when saturated, then fall back
+	IdleTimeout time.Duration // close pooled connections idle for longer
+	KeepAlive   bool          // negotiate EDNS TCP keepalive (RFC 7828)
+	Warm        int           // connections opened at startup and kept open
+
+	// TLS options
+	ServerName string   // SNI and name verified in the certificate
+	CAFile     string   // CA bundle replacing the system roots
+	Pins       [][]byte // SHA-256 of accepted public keys (RFC 7858 pinning)
+	Insecure   bool     // skip certificate verification (lab only)
+	CertFile   string   // client certificate (mutual TLS)
+	KeyFile    string   // client certificate private key
+	TLSConfig  *tls.Config
+}
+
+// serverDefaults holds the options of servers that don't set them. The
+// command line flags can change them.
+var serverDefaults = Server{
+	Timeout:     defaultUpstreamTimeout,
+	PoolSize:    defaultMaxPerServer,
+	PoolWait:    defaultPoolWait,
+	IdleTimeout: defaultIdleTimeout,
+	KeepAlive:   true,
+	Padding:     true,
+	Cookie:      true,
+}
+
+// parseServer parses an upstream server URL with its options.
+func parseServer(serverStr string) (Server, error) {
+	withoutName, serverName, _ := strings.Cut(serverStr, "#")
+	if strings.Contains(serverName, "?") {
+		// the options would be taken as part of the name
+		return Server{}, fmt.Errorf("SERVER NAME ERROR: options must come before #: %s", serverStr)
+	}
+	base, rawQuery, _ := strings.Cut(withoutName, "?")
+	scheme, addr, port, err := extractServerURL(base)
+	if err != nil {
+		return Server{}, err
+	}
+	serv := serverDefaults
+	serv.URL = serverStr
+	serv.Scheme = scheme
+	serv.Addr = addr
+	serv.Port = port
+	serv.ServerName = serverName
+
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Server{}, fmt.Errorf("SERVER OPTIONS ERROR: %s", rawQuery)
+	}
+	for name, values := range params {
+		value := values[len(values)-1]
+		switch name {
+		case "timeout":
+			serv.Timeout, err = parsePositiveDuration(value)
+		case "source":
+			serv.Source, err = parseSource(value)
+		case "interface":
+			serv.Interface = value
+			_, err = bindControl(value)
+		case "proxy":
+			serv.Proxy, err = parseProxy(value)
+		case "pool":
+			serv.PoolSize, err = strconv.Atoi(value)
+			if err == nil && serv.PoolSize < 1 {
+				err = fmt.Errorf("pool size must be at least 1")
+			}
+		case "wait":
+			serv.PoolWait, err = parseNonNegativeDuration(value)
+		case "idle":
+			serv.IdleTimeout, err = parseNonNegativeDuration(value)
+		case "keepalive":
+			serv.KeepAlive, err = strconv.ParseBool(value)
+		case "warm":
+			serv.Warm, err = strconv.Atoi(value)
+			if err == nil && serv.Warm < 0 {
+				err = fmt.Errorf("warm connections must not be negative")
+			}
+		case "padding":
+			serv.Padding, err = strconv.ParseBool(value)
+		case "0x20":
+			serv.RandomCase, err = strconv.ParseBool(value)
+		case "cookie":
+			serv.Cookie, err = strconv.ParseBool(value)
+		case "ca":
+			serv.CAFile = value
+		case "pin":
+			serv.Pins, err = parsePins(values)
+		case "insecure":
+			serv.Insecure, err = strconv.ParseBool(value)
+		case "cert":
+			serv.CertFile = value
+		case "key":
+			serv.KeyFile = value
+		default:
+			return Server{}, fmt.Errorf("UNKNOWN SERVER OPTION: %s", name)
+		}
+		if err != nil {
+			return Server{}, fmt.Errorf("SERVER OPTION ERROR: %s=%s: %s", name, value, err)
+		}
+	}
+
+	if serv.Scheme != "tcp-tls" {
+		if serv.ServerName != "" || serv.CAFile != "" || serv.Pins != nil || serv.Insecure ||
+			serv.CertFile != "" || serv.KeyFile != "" {
+			return Server{}, fmt.Errorf("TLS OPTIONS ON A %s SERVER: %s", serv.Scheme, serverStr)
+		}
+		return serv, nil
+	}
+	serv.TLSConfig, err = newTLSConfig(serv)
+	if err != nil {
+		return Server{}, fmt.Errorf("SERVER TLS ERROR: %s", err)
+	}
+	return serv, nil
+}
+
+func extractServerURL(inputURL string) (string, string, int, error) {
+	re := regexp.MustCompile(`^(?P<Scheme>[a-z]+)://(?:\[(?P<IPv6>[0-9a-fA-F:]+)\]|(?P<IPv4>[^:/]+))(?::(?P<Port>\d+))?$`)
+	matches := re.FindStringSubmatch(inputURL)
+
+	if len(matches) == 0 {
+		return "", "", 0, fmt.Errorf("WRONG SERVER FORMAT: %s", inputURL)
+	}
+
+	scheme := strings.ToLower(matches[re.SubexpIndex("Scheme")])
+	ipv6 := matches[re.SubexpIndex("IPv6")]
+	ipv4 := matches[re.SubexpIndex("IPv4")]
+	port := matches[re.SubexpIndex("Port")]
+
+	// the IPv4 group also matches host names, resolved by the bootstrap
+	addr := ipv4
+	if ipv6 != "" {
+		addr = ipv6
+	} else if net.ParseIP(addr) == nil {
+		hostRe := regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+		if !hostRe.MatchString(addr) {
+			return "", "", 0, fmt.Errorf("SERVER ADDRESS ERROR: %s", addr)
+		}
+	}
+
+	switch scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", 0, fmt.Errorf("SERVER SCHEME ERROR: %s://", scheme)
+	}
+
+	finalPort := 53
+	if port == "" {
+		if scheme == "tls" {
+			finalPort = 853
+		}
+	} else {
+		var err error
+		finalPort, err = strconv.Atoi(port)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("SERVER PORT ERROR: %s", port)
+		}
+	}
+
+	if scheme == "tls" {
+		scheme = "tcp-tls"
+	}
+
+	return scheme, addr, finalPort, nil
+}
+
+// parseSource parses a source address
+func parseSource(value string) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address")
+	}
+	return ip, nil
+}
+
+// parsePositiveDuration parses a duration that must be strictly positive
+func parsePositiveDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("duration must be positive")
+	}
+	return d, err
+}
+
+// parseNonNegativeDuration parses a duration that may be zero, not negative
+func parseNonNegativeDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("duration must not be negative")
+	}
+	return d, err
+}
+
+// address returns the host:port of the server, as configured
+func (s Server) address() string {
+	return net.JoinHostPort(s.Addr, strconv.Itoa(s.Port))
+}
+
+// key identifies the server in the connection pool, with the options that
+// may come from its zone
+func (s Server) key() string {
+	key := s.URL
+	if s.Source != nil {
+		key += " source=" + s.Source.String()
+	}
+	if s.Interface != "" {
+		key += " interface=" + s.Interface
+	}
+	if s.Proxy != nil {
+		key += " proxy=" + s.Proxy.Redacted()
+	}
+	return key
+}
+
+// dialAddresses returns the ip:port to dial, in turn until one answers,
+// resolving the host name of the server through the bootstrap servers if
+// needed. With a source address, only the addresses of its family are kept.
+func (s Server) dialAddresses() ([]string, error) {
+	if net.ParseIP(s.Addr) != nil {
+		return []string{s.address()}, nil
+	}
+	ips, err := bootstrap.lookup(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if s.Source == nil || (ip.To4() != nil) == (s.Source.To4() != nil) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(s.Port)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of %s in the family of source %s", s.Addr, s.Source)
+	}
+	return addrs, nil
+}
+
+// client returns a dns.Client to query this server
+func (s Server) client() *dns.Client {
+	c := &dns.Client{Net: s.Scheme, Timeout: s.Timeout, TLSConfig: s.TLSConfig}
+	if s.Source == nil && s.Interface == "" {
+		return c
+	}
+
+	c.Dialer = &net.Dialer{Timeout: s.Timeout}
+	if s.Source != nil {
+		if s.Scheme == "udp" {
+			c.Dialer.LocalAddr = &net.UDPAddr{IP: s.Source}
+		} else {
+			c.Dialer.LocalAddr = &net.TCPAddr{IP: s.Source}
+		}
+	}
+	if s.Interface != "" {
+		c.Dialer.Control, _ = bindControl(s.Interface) // checked by parseServer
+	}
+	return c
+}
+
+// dial opens a TCP/TLS connection to the server. Through a proxy, the host
+// name of the server is resolved by the proxy.
+func (s Server) dial(c *dns.Client) (*dns.Conn, error) {
+	if s.Proxy == nil {
+		addrs, err := s.dialAddresses()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			var conn *dns.Conn
+			if conn, err = c.Dial(addr); err == nil {
+				return conn, nil
+			}
+			log.Debugf("%s: %s", s, err)
+		}
+		return nil, err
+	}
+
+	forward := c.Dialer
+	if forward == nil {
+		forward = &net.Dialer{Timeout: s.Timeout}
+	}
+	conn, err := proxyDial(s.Proxy, forward, s.address(), s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if s.Scheme == "tcp-tls" {
+		tlsConn := tls.Client(conn, s.TLSConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (s Server) String() string {
+	scheme := s.Scheme
+	if scheme == "tcp-tls" {
+		scheme = "tls"
+	}
+	if s.ServerName != "" {
+		return scheme + "://" + s.address() + "#" + s.ServerName
+	}
+	return scheme + "://" + s.address()
+}
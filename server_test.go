@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		url    string
+		scheme string
+		addr   string
+		port   int
+		check  func(Server) bool
+	}{
+		{"udp://9.9.9.9", "udp", "9.9.9.9", 53,
+			func(s Server) bool { return !s.RandomCase && s.Cookie }},
+		{"tcp://9.9.9.9:5353", "tcp", "9.9.9.9", 5353, nil},
+		{"tls://9.9.9.9", "tcp-tls", "9.9.9.9", 853, nil},
+		{"udp://[2620:fe::9]", "udp", "2620:fe::9", 53, nil},
+		{"tls://[2620:fe::9]:8853", "tcp-tls", "2620:fe::9", 8853, nil},
+		{"tls://dns.quad9.net", "tcp-tls", "dns.quad9.net", 853, nil},
+		{"tls://9.9.9.9#dns.quad9.net", "tcp-tls", "9.9.9.9", 853,
+			func(s Server) bool { return s.ServerName == "dns.quad9.net" }},
+		{"tls://9.9.9.9?insecure=true#dns.quad9.net", "tcp-tls", "9.9.9.9", 853,
+			func(s Server) bool { return s.ServerName == "dns.quad9.net" && s.Insecure }},
+		{"udp://9.9.9.9?timeout=500ms", "udp", "9.9.9.9", 53,
+			func(s Server) bool { return s.Timeout == 500*time.Millisecond }},
+		{"tcp://9.9.9.9?pool=16&wait=250ms&idle=20s&warm=2", "tcp", "9.9.9.9", 53,
+			func(s Server) bool {
+				return s.PoolSize == 16 && s.PoolWait == 250*time.Millisecond &&
+					s.IdleTimeout == 20*time.Second && s.Warm == 2
+			}},
+		{"tcp://9.9.9.9?wait=0s&idle=0s&warm=0", "tcp", "9.9.9.9", 53,
+			func(s Server) bool { return s.PoolWait == 0 && s.IdleTimeout == 0 && s.Warm == 0 }},
+		{"tcp://9.9.9.9?keepalive=false", "tcp", "9.9.9.9", 53,
+			func(s Server) bool { return !s.KeepAlive }},
+		{"udp://9.9.9.9?source=192.0.2.1", "udp", "9.9.9.9", 53,
+			func(s Server) bool { return s.Source.String() == "192.0.2.1" }},
+		{"tcp://9.9.9.9?proxy=socks5://127.0.0.1:1080", "tcp", "9.9.9.9", 53,
+			func(s Server) bool { return s.Proxy.Host == "127.0.0.1:1080" }},
+		{"udp://9.9.9.9?0x20=true&cookie=false", "udp", "9.9.9.9", 53,
+			func(s Server) bool { return s.RandomCase && !s.Cookie }},
+	}
+	for _, tt := range tests {
+		serv, err := parseServer(tt.url)
+		if err != nil {
+			t.Errorf("%s: %s", tt.url, err)
+			continue
+		}
+		if serv.Scheme != tt.scheme || serv.Addr != tt.addr || serv.Port != tt.port {
+			t.Errorf("%s: got %s %s %d", tt.url, serv.Scheme, serv.Addr, serv.Port)
+		}
+		if tt.check != nil && !tt.check(serv) {
+			t.Errorf("%s: wrong options %+v", tt.url, serv)
+		}
+	}
+}
+
+func TestParseServerErrors(t *testing.T) {
+	tests := []struct {
+		url string
+		err string
+	}{
+		{"9.9.9.9", "WRONG SERVER FORMAT"},
+		{"https://9.9.9.9", "SERVER SCHEME ERROR"},
+		{"udp://bad_host", "SERVER ADDRESS ERROR"},
+		{"udp://9.9.9.9?foo=1", "UNKNOWN SERVER OPTION"},
+		{"udp://9.9.9.9?timeout=0s", "SERVER OPTION ERROR"},
+		{"udp://9.9.9.9?timeout=-1s", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?pool=0", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?wait=-1ms", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?idle=-1s", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?warm=-1", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?keepalive=maybe", "SERVER OPTION ERROR"},
+		{"udp://9.9.9.9?source=nowhere", "SERVER OPTION ERROR"},
+		{"tcp://9.9.9.9?proxy=ftp://127.0.0.1", "SERVER OPTION ERROR"},
+		{"udp://9.9.9.9#dns.quad9.net", "TLS OPTIONS ON A udp SERVER"},
+		{"tls://9.9.9.9#dns.quad9.net?insecure=true", "SERVER NAME ERROR"},
+		{"tls://9.9.9.9?pin=sha1/abc", "SERVER OPTION ERROR"},
+	}
+	for _, tt := range tests {
+		_, err := parseServer(tt.url)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %s", tt.url, err, tt.err)
+		}
+	}
+}
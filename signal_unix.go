@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// flushOnSignal flushes the whole cache each time SIGUSR1 is received.
+func (fw *Forwarder) flushOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		log.Info("Received SIGUSR1, flushing cache")
+		fw.flushCache(matchAll)
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+// flushOnSignal is a no-op: there is no SIGUSR1 on Windows, use the
+// control socket instead.
+func (fw *Forwarder) flushOnSignal() {}
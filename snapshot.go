@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheSnapshotEntry is the on-disk form of a CacheEntry. The response is
+// stored in wire format and the expiry as an absolute time, so entries that
+// expired while OwNS was down are dropped on reload.
+type cacheSnapshotEntry struct {
+	Key    string    `json:"key"`
+	Msg    []byte    `json:"msg"`
+	Expiry time.Time `json:"expiry"`
+	Zone   string    `json:"zone,omitempty"`
+}
+
+// saveCache writes the live cache entries to filename. The file is replaced
+// atomically so a crash never leaves a half-written snapshot behind, and
+// saves are serialized: the periodic one may run at shutdown.
+func (fw *Forwarder) saveCache(filename string) error {
+	fw.saveMu.Lock()
+	defer fw.saveMu.Unlock()
+	now := time.Now()
+	var entries []cacheSnapshotEntry
+
+	fw.cacheMu.RLock()
+	for key, entry := range fw.cache {
+		if entry.Expiry.Before(now) {
+			continue
+		}
+		msg, err := entry.Response.Pack()
+		if err != nil {
+			log.Debugf("cache snapshot: skipping %s: %s", key, err)
+			continue
+		}
+		entries = append(entries, cacheSnapshotEntry{Key: key, Msg: msg, Expiry: entry.Expiry, Zone: entry.Zone})
+	}
+	fw.cacheMu.RUnlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	log.Debugf("cache snapshot: saved %d entries to %s", len(entries), filename)
+	return nil
+}
+
+// loadCache fills the cache from a snapshot written by saveCache. A missing
+// file is not an error (first start).
+func (fw *Forwarder) loadCache(filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []cacheSnapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	loaded, expired, invalid := 0, 0, 0
+	fw.cacheMu.Lock()
+	for _, e := range entries {
+		if e.Expiry.Before(now) {
+			expired++
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			log.Debugf("cache snapshot: skipping %s: %s", e.Key, err)
+			invalid++
+			continue
+		}
+		fw.cache[e.Key] = CacheEntry{Response: msg, Expiry: e.Expiry, Zone: e.Zone}
+		loaded++
+	}
+	fw.cacheMu.Unlock()
+
+	log.Infof("Loaded %d cache entries from %s (%d expired, %d invalid)", loaded, filename, expired, invalid)
+	return nil
+}
+
+// Loop forever to save the cache periodically
+func (fw *Forwarder) persistCache(filename string) {
+	for {
+		time.Sleep(cacheSaveInterval)
+		if err := fw.saveCache(filename); err != nil {
+			log.Warningf("Error saving cache: %s", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testCacheEntry(t *testing.T, name string, ttl time.Duration) CacheEntry {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	rr, err := dns.NewRR(name + " 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = append(m.Answer, rr)
+	return CacheEntry{Response: m, Expiry: time.Now().Add(ttl), Zone: "lan"}
+}
+
+// Live entries survive a save and a load, expired ones are dropped.
+func TestCacheSnapshot(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	fw := &Forwarder{cache: map[string]CacheEntry{
+		"www.example.com.:1": testCacheEntry(t, "www.example.com.", time.Hour),
+		"old.example.com.:1": testCacheEntry(t, "old.example.com.", -time.Second),
+	}}
+	if err := fw.saveCache(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Forwarder{cache: map[string]CacheEntry{}}
+	if err := loaded.loadCache(filename); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.cache) != 1 {
+		t.Fatalf("%d entries loaded, want 1", len(loaded.cache))
+	}
+	entry, ok := loaded.cache["www.example.com.:1"]
+	want := fw.cache["www.example.com.:1"]
+	if !ok || entry.Zone != "lan" || !entry.Expiry.Equal(want.Expiry) ||
+		entry.Response.String() != want.Response.String() {
+		t.Errorf("got %+v, want %+v", entry, want)
+	}
+}
+
+// Entries expired while OwNS was down, and unreadable ones, are skipped.
+func TestLoadCache(t *testing.T) {
+	live, _ := testCacheEntry(t, "www.example.com.", time.Hour).Response.Pack()
+	entries := []cacheSnapshotEntry{
+		{Key: "live", Msg: live, Expiry: time.Now().Add(time.Hour)},
+		{Key: "expired", Msg: live, Expiry: time.Now().Add(-time.Minute)},
+		{Key: "invalid", Msg: []byte{1, 2, 3}, Expiry: time.Now().Add(time.Hour)},
+	}
+	data, _ := json.Marshal(entries)
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(filename, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fw := &Forwarder{cache: map[string]CacheEntry{}}
+	if err := fw.loadCache(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fw.cache["live"]; !ok || len(fw.cache) != 1 {
+		t.Errorf("loaded %v, want live only", fw.cache)
+	}
+
+	if err := fw.loadCache(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("missing file: %s", err)
+	}
+	os.WriteFile(filename, []byte("not json"), 0o600)
+	if err := fw.loadCache(filename); err == nil {
+		t.Error("invalid file loaded")
+	}
+}
+
+// Concurrent saves, periodic and at shutdown, leave a complete snapshot.
+func TestConcurrentCacheSaves(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	fw := &Forwarder{cache: map[string]CacheEntry{}}
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		fw.cache[name+":1"] = testCacheEntry(t, name, time.Hour)
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fw.saveCache(filename); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	loaded := &Forwarder{cache: map[string]CacheEntry{}}
+	if err := loaded.loadCache(filename); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.cache) != 3 {
+		t.Errorf("%d entries loaded, want 3", len(loaded.cache))
+	}
+}
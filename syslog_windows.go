@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// newSyslogWriter fails: there is no syslog on Windows, log to a file
+// instead.
+func newSyslogWriter() (io.Writer, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
@@ -0,0 +1,241 @@
+//go:build ignore
+
+// test_dnstap — a minimal dnstap collector, printing the messages of OwNS.
+//
+// Usage:
+//   cd github/owns && go run tests/test_dnstap.go /tmp/dnstap.sock
+//   ./owns -dnstap unix:/tmp/dnstap.sock
+//
+// or, to read a file written with -dnstap /tmp/owns.tap:
+//   go run tests/test_dnstap.go -file /tmp/owns.tap
+//
+// The script accepts the Frame Streams sessions on the socket, then prints
+// one line per message: its type, the addresses and the DNS question with
+// the rcode of the responses.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const contentType = "protobuf:dnstap.Dnstap"
+
+var messageTypes = map[uint64]string{
+	5: "CLIENT_QUERY",
+	6: "CLIENT_RESPONSE",
+	7: "FORWARDER_QUERY",
+	8: "FORWARDER_RESPONSE",
+}
+
+var protocols = map[uint64]string{1: "udp", 2: "tcp", 3: "dot"}
+
+func main() {
+	file := flag.Bool("file", false, "read a dnstap file instead of listening")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("usage: test_dnstap [-file] path")
+		os.Exit(1)
+	}
+	path := flag.Arg(0)
+
+	if *file {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := readFrames(f); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("listening on %s\n", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Println("== session opened")
+			if err := session(conn); err != nil {
+				fmt.Printf("== session closed: %s\n", err)
+			}
+		}()
+	}
+}
+
+// session runs the bidirectional handshake: READY, ACCEPT, then the frames
+// until STOP, answered by FINISH.
+func session(conn net.Conn) error {
+	ctype, err := readControl(conn)
+	if err != nil {
+		return err
+	}
+	if ctype != 4 {
+		return fmt.Errorf("expected READY, got %d", ctype)
+	}
+	if err := writeControl(conn, 1); err != nil {
+		return err
+	}
+	if err := readFrames(conn); err != nil {
+		return err
+	}
+	return writeControl(conn, 5)
+}
+
+// readFrames reads START, then the data frames until STOP.
+func readFrames(r io.Reader) error {
+	ctype, err := readControl(r)
+	if err != nil {
+		return err
+	}
+	if ctype != 2 {
+		return fmt.Errorf("expected START, got %d", ctype)
+	}
+	for {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		if n == 0 {
+			// control frame: the length follows, then STOP
+			var length, ctype uint32
+			binary.Read(r, binary.BigEndian, &length)
+			binary.Read(r, binary.BigEndian, &ctype)
+			io.CopyN(io.Discard, r, int64(length)-4)
+			fmt.Println("== STOP")
+			return nil
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return err
+		}
+		if err := printFrame(frame); err != nil {
+			fmt.Printf("bad frame: %s\n", err)
+		}
+	}
+}
+
+func readControl(r io.Reader) (uint32, error) {
+	var header [3]uint32 // escape, length, type
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	if header[0] != 0 || header[1] < 4 {
+		return 0, errors.New("bad control frame")
+	}
+	_, err := io.CopyN(io.Discard, r, int64(header[1])-4) // content type
+	return header[2], err
+}
+
+func writeControl(w io.Writer, ctype uint32) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0)
+	if ctype == 1 {
+		b = binary.BigEndian.AppendUint32(b, uint32(12+len(contentType)))
+		b = binary.BigEndian.AppendUint32(b, ctype)
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, 4)
+		b = binary.BigEndian.AppendUint32(b, ctype)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// fields decodes a protobuf message: varints and fixed32 as numbers,
+// length-delimited fields as bytes.
+func fields(b []byte) (map[uint64]uint64, map[uint64][]byte, error) {
+	nums, bufs := map[uint64]uint64{}, map[uint64][]byte{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("bad tag")
+		}
+		b = b[n:]
+		field := tag >> 3
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, nil, errors.New("bad varint")
+			}
+			nums[field], b = v, b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, nil, errors.New("bad length")
+			}
+			bufs[field], b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, nil, errors.New("bad fixed32")
+			}
+			nums[field], b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return nil, nil, fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+	}
+	return nums, bufs, nil
+}
+
+func printFrame(frame []byte) error {
+	_, tap, err := fields(frame)
+	if err != nil {
+		return err
+	}
+	nums, bufs, err := fields(tap[14])
+	if err != nil {
+		return err
+	}
+
+	address := func(addr, port uint64) string {
+		if bufs[addr] == nil {
+			return "-"
+		}
+		return net.JoinHostPort(net.IP(bufs[addr]).String(), fmt.Sprint(nums[port]))
+	}
+	wire, sec, nsec := bufs[10], nums[8], nums[9]
+	if wire == nil {
+		wire, sec, nsec = bufs[14], nums[12], nums[13]
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(wire); err != nil {
+		return err
+	}
+	summary := "-"
+	if len(m.Question) > 0 {
+		q := m.Question[0]
+		summary = fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
+	}
+	if m.Response {
+		summary += fmt.Sprintf(" %s, %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+
+	fmt.Printf("%s %s/%s %-18s %s %s → %s %s\n",
+		time.Unix(int64(sec), int64(nsec)).Format("15:04:05.000"),
+		tap[1], tap[2], messageTypes[nums[1]], protocols[nums[3]],
+		address(4, 6), address(5, 7), summary)
+	return nil
+}
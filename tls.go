@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newTLSConfig builds the TLS configuration of a DoT server.
+//
+// The certificate is verified against ServerName (the address when empty),
+// using CAFile or the system roots. With pins, the server is instead
+// authenticated by its public key (RFC 7858 out-of-band key-pinned profile):
+// its certificate must match one of the pins. A client
+// certificate is presented when the server asks for one (mutual TLS).
+func newTLSConfig(serv Server) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serv.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.ServerName == "" {
+		config.ServerName = serv.Addr
+	}
+
+	if serv.CAFile != "" {
+		pem, err := os.ReadFile(serv.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", serv.CAFile)
+		}
+	}
+
+	switch {
+	case len(serv.Pins) > 0:
+		pins := serv.Pins
+		config.InsecureSkipVerify = true // replaced by the pin check
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPins(rawCerts, pins)
+		}
+	case serv.Insecure:
+		config.InsecureSkipVerify = true
+	}
+
+	if serv.CertFile != "" || serv.KeyFile != "" {
+		if serv.CertFile == "" || serv.KeyFile == "" {
+			return nil, errors.New("client certificate needs both cert and key")
+		}
+		cc, err := newClientCert(serv.CertFile, serv.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = cc.get
+	}
+	return config, nil
+}
+
+// parsePins decodes pins written as sha256/<base64 of the SPKI digest>,
+// like `openssl x509 -pubkey | openssl pkey -pubin -outform der |
+// openssl dgst -sha256 -binary | base64` prints.
+func parsePins(values []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, value := range values {
+		b64, ok := strings.CutPrefix(value, "sha256/")
+		if !ok {
+			return nil, errors.New("pin must start with sha256/")
+		}
+		// '+' is decoded as a space in URL query strings
+		b64 = strings.ReplaceAll(b64, " ", "+")
+		pin, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, err
+		}
+		if len(pin) != sha256.Size {
+			return nil, errors.New("pin is not a SHA-256 digest")
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifyPins accepts the chain if the public key of the server certificate
+// matches one of the pins. The chain is not verified, so the other
+// certificates, sent by the server, prove nothing: only the leaf is checked,
+// its key being the one the handshake is signed with.
+func verifyPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(digest[:], pin) {
+			return nil
+		}
+	}
+	return errors.New("server certificate doesn't match the pinned keys")
+}
+
+// clientCert is a client certificate loaded from PEM files. The files are
+// checked at each handshake and reloaded when they change, so a renewed
+// certificate is used without restarting.
+type clientCert struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time // most recent modification of the files
+}
+
+func newClientCert(certFile, keyFile string) (*clientCert, error) {
+	cc := &clientCert{certFile: certFile, keyFile: keyFile}
+	if err := cc.load(cc.filesModTime()); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// filesModTime returns the most recent modification time of the files, or
+// zero if they can't be read (e.g. in the middle of a rotation).
+func (cc *clientCert) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{cc.certFile, cc.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (cc *clientCert) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		return err
+	}
+	cc.cert = &cert
+	cc.modTime = modTime
+	return nil
+}
+
+// get is the tls.Config GetClientCertificate callback.
+func (cc *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if modTime := cc.filesModTime(); !modTime.IsZero() && !modTime.Equal(cc.modTime) {
+		if err := cc.load(modTime); err != nil {
+			log.Warningf("Error reloading client certificate %s: %s", cc.certFile, err)
+		} else {
+			log.Infof("Reloaded client certificate %s", cc.certFile)
+		}
+	}
+	return cc.cert, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its private key.
+type testCert struct {
+	der  []byte
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for 127.0.0.1, signed by parent, or
+// self-signed when parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{der: der, cert: cert, key: key}
+}
+
+// pin returns the SHA-256 digest of the public key of the certificate.
+func (c *testCert) pin() []byte {
+	digest := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca := newTestCert(t, "ca", true, nil)
+	leaf := newTestCert(t, "leaf", false, ca)
+	pinned := newTestCert(t, "pinned", false, nil)
+	attacker := newTestCert(t, "attacker", false, nil)
+
+	tests := []struct {
+		name  string
+		chain []*testCert
+		pins  [][]byte
+		ok    bool
+	}{
+		{"pinned leaf", []*testCert{pinned}, [][]byte{pinned.pin()}, true},
+		{"second pin", []*testCert{pinned}, [][]byte{attacker.pin(), pinned.pin()}, true},
+		{"pinned leaf with its CA", []*testCert{leaf, ca}, [][]byte{leaf.pin()}, true},
+		{"other leaf", []*testCert{attacker}, [][]byte{pinned.pin()}, false},
+		{"other leaf followed by the pinned one", []*testCert{attacker, pinned}, [][]byte{pinned.pin()}, false},
+		{"pinned CA", []*testCert{leaf, ca}, [][]byte{ca.pin()}, false},
+		{"no certificate", nil, [][]byte{pinned.pin()}, false},
+	}
+	for _, tt := range tests {
+		var rawCerts [][]byte
+		for _, c := range tt.chain {
+			rawCerts = append(rawCerts, c.der)
+		}
+		if err := verifyPins(rawCerts, tt.pins); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// A server presenting its own certificate followed by a copy of the pinned
+// one fails the handshake.
+func TestPinnedHandshake(t *testing.T) {
+	pinned := newTestCert(t, "pinned", false, nil)
+	attacker := newTestCert(t, "attacker", false, nil)
+
+	tests := []struct {
+		name  string
+		chain tls.Certificate
+		ok    bool
+	}{
+		{"pinned server", tls.Certificate{Certificate: [][]byte{pinned.der}, PrivateKey: pinned.key}, true},
+		{"other server", tls.Certificate{Certificate: [][]byte{attacker.der}, PrivateKey: attacker.key}, false},
+		{"other server with the pinned certificate",
+			tls.Certificate{Certificate: [][]byte{attacker.der, pinned.der}, PrivateKey: attacker.key}, false},
+	}
+	for _, tt := range tests {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{tt.chain}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}()
+
+		serv, err := parseServer("tls://" + ln.Addr().String() + "?pin=sha256/" + base64.StdEncoding.EncodeToString(pinned.pin()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), serv.TLSConfig)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.name, err, tt.ok)
+		}
+		ln.Close()
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	digest := sha256.Sum256([]byte("key"))
+	b64 := base64.StdEncoding.EncodeToString(digest[:])
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"sha256/" + b64, true},
+		{b64, false},
+		{"sha1/" + b64, false},
+		{"sha256/not base64!", false},
+		{"sha256/" + base64.StdEncoding.EncodeToString(digest[:20]), false},
+	}
+	for _, tt := range tests {
+		pins, err := parsePins([]string{tt.value})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.value, err, tt.ok)
+		}
+		if tt.ok && (len(pins) != 1 || string(pins[0]) != string(digest[:])) {
+			t.Errorf("%s: got %x", tt.value, pins)
+		}
+	}
+}
+
+// writePEM writes the certificate, or its key, in PEM to filename, with a
+// modification time of its own.
+func (c *testCert) writePEM(t *testing.T, filename string, key bool, modTime time.Time) {
+	t.Helper()
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: c.der}
+	if key {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+	if err := os.WriteFile(filename, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A renewed client certificate is presented at the next handshake, once its
+// certificate and key files match.
+func TestClientCertReload(t *testing.T) {
+	server := newTestCert(t, "server", false, nil)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	presented := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				presented <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			} else {
+				presented <- ""
+			}
+			conn.Close()
+		}
+	}()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	old, renewed := newTestCert(t, "old", false, nil), newTestCert(t, "renewed", false, nil)
+	start := time.Now().Add(-time.Hour)
+	old.writePEM(t, certFile, false, start)
+	old.writePEM(t, keyFile, true, start)
+	serv, err := parseServer("tls://" + ln.Addr().String() + "?insecure=true&cert=" + certFile + "&key=" + keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update func()
+		want   string
+	}{
+		{"loaded", func() {}, "old"},
+		{"certificate renewed, not the key yet", func() {
+			renewed.writePEM(t, certFile, false, start.Add(time.Minute))
+		}, "old"},
+		{"key renewed", func() {
+			renewed.writePEM(t, keyFile, true, start.Add(2*time.Minute))
+		}, "renewed"},
+		{"key being replaced", func() { os.Remove(keyFile) }, "renewed"},
+		{"back to the old pair", func() {
+			old.writePEM(t, certFile, false, start.Add(3*time.Minute))
+			old.writePEM(t, keyFile, true, start.Add(3*time.Minute))
+		}, "old"},
+	}
+	for _, tt := range tests {
+		tt.update()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), serv.TLSConfig)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		conn.Close()
+		if got := <-presented; got != tt.want {
+			t.Errorf("%s: presented %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
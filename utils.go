@@ -74,3 +74,14 @@ func reverseToIPv6(inverseIP string) net.IP {
 	log.Debugf("reversed %s => %s", inverseIP, ipStr)
 	return net.ParseIP(ipStr)
 }
+
+// remoteIP returns the IP address of a client.
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// =============================================================================
+// Strict configuration
+// =============================================================================
+
+// configError is a problem of a configuration file, at a position.
+type configError struct {
+	file         string
+	line, column int
+	err          error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.file, e.line, e.column, e.err)
+}
+
+func (e *configError) Unwrap() error { return e.err }
+
+// configProblems rejects a configuration, its problems being logged one by
+// one.
+type configProblems []error
+
+func (p configProblems) Error() string {
+	return fmt.Sprintf("Invalid configuration: %d problems", len(p))
+}
+
+// configFields are the keys of a zone and their types, from the yaml tags
+// of ForwardConfig.
+var configFields = func() map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	t := reflect.TypeOf(ForwardConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		fields[name] = t.Field(i).Type
+	}
+	return fields
+}()
+
+// typeNames describe the expected values in the problems.
+var typeNames = map[reflect.Kind]string{
+	reflect.Slice:  "a list",
+	reflect.String: "a string",
+	reflect.Bool:   "a boolean",
+	reflect.Int:    "a number",
+}
+
+// zoneEntry is a network or domain of a zone, where it is configured.
+type zoneEntry struct {
+	zone  string
+	node  *yaml.Node
+	ipNet *net.IPNet // networks
+	name  string     // domains, canonical
+}
+
+// validateConfig checks forward.yaml strictly: unknown keys, invalid values,
+// zones without servers, several default blocks, and networks or domains
+// never matched because an earlier zone holds them. Zones partly shadowed
+// by an earlier, more specific, network or domain are only warned about, as
+// this is how they are meant to be ordered. With longestMatch, the order
+// doesn't matter: only duplicates are rejected.
+func validateConfig(filename string, data []byte, longestMatch bool) (problems, warnings []error) {
+	at := func(node *yaml.Node, format string, args ...any) error {
+		return &configError{filename, node.Line, node.Column, fmt.Errorf(format, args...)}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []error{fmt.Errorf("%s: %w", filename, err)}, nil
+	}
+	if len(root.Content) == 0 {
+		return nil, nil // empty file
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.SequenceNode {
+		return []error{at(doc, "EXPECTED A LIST OF ZONES")}, nil
+	}
+
+	var networks, domains []zoneEntry
+	var defaultBlock *yaml.Node
+	for _, block := range doc.Content {
+		if block.Kind != yaml.MappingNode {
+			problems = append(problems, at(block, "EXPECTED A ZONE"))
+			continue
+		}
+		fields := map[string]*yaml.Node{}
+		valid := true
+		for i := 0; i+1 < len(block.Content); i += 2 {
+			key, value := block.Content[i], block.Content[i+1]
+			fieldType, ok := configFields[key.Value]
+			if !ok {
+				problems = append(problems, at(key, "UNKNOWN FIELD: %s", key.Value))
+				continue
+			}
+			if err := value.Decode(reflect.New(fieldType).Interface()); err != nil {
+				problems = append(problems, at(value, "TYPE ERROR: %s expects %s", key.Value, typeNames[fieldType.Kind()]))
+				valid = false
+			}
+			fields[key.Value] = value
+		}
+		var config ForwardConfig
+		if !valid || block.Decode(&config) != nil {
+			continue
+		}
+		name := zoneName(config)
+
+		for i, networkStr := range config.Networks {
+			node := fields["networks"].Content[i]
+			_, ipNet, err := net.ParseCIDR(networkStr)
+			if err != nil {
+				problems = append(problems, at(node, "CIDR ERROR: %s", networkStr))
+				continue
+			}
+			if len(ipNet.IP) == net.IPv6len && ipNet.IP.To4() != nil {
+				ipv4Net := &net.IPNet{IP: ipNet.IP.To4(), Mask: ipNet.Mask[net.IPv6len-net.IPv4len:]}
+				problems = append(problems, at(node, "IPV4-MAPPED NETWORK: %s, matching IPv4 addresses as %s", networkStr, ipv4Net))
+			}
+			networks = append(networks, zoneEntry{zone: name, node: node, ipNet: ipNet})
+		}
+		for i, domain := range config.Domains {
+			node := fields["domains"].Content[i]
+			if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+				problems = append(problems, at(node, "DOMAIN ERROR: %s", domain))
+				continue
+			}
+			domains = append(domains, zoneEntry{zone: name, node: node, name: dns.CanonicalName(domain)})
+		}
+		for i, serverStr := range config.Servers {
+			if _, err := parseServer(serverStr); err != nil {
+				problems = append(problems, at(fields["servers"].Content[i], "%s", err))
+			}
+		}
+		if config.Source != "" {
+			if _, err := parseSource(config.Source); err != nil {
+				problems = append(problems, at(fields["source"], "%s", err))
+			}
+		}
+		if config.Interface != "" {
+			if _, err := bindControl(config.Interface); err != nil {
+				problems = append(problems, at(fields["interface"], "%s", err))
+			}
+		}
+		if config.Proxy != "" {
+			if _, err := parseProxy(config.Proxy); err != nil {
+				problems = append(problems, at(fields["proxy"], "%s", err))
+			}
+		}
+		if _, err := parseECSPolicy(config); err != nil {
+			node := fields["ecs"]
+			if node == nil {
+				node = block
+			}
+			problems = append(problems, at(node, "%s", err))
+		}
+
+		if len(config.Servers) == 0 && !config.Recursive {
+			problems = append(problems, at(block, "ZONE WITHOUT SERVERS: %s", name))
+		}
+		if len(config.Networks) == 0 && len(config.Domains) == 0 {
+			if defaultBlock != nil {
+				problems = append(problems, at(block, "SEVERAL DEFAULT BLOCKS: first at line %d", defaultBlock.Line))
+			} else {
+				defaultBlock = block
+			}
+		}
+	}
+
+	// zones are searched in file order: the first holding an address or a
+	// name answers it
+	for j, later := range networks {
+		for _, earlier := range networks[:j] {
+			switch {
+			case earlier.ipNet.String() == later.ipNet.String():
+				problems = append(problems, at(later.node, "DUPLICATE NETWORK: %s (zone %s, line %d)",
+					later.ipNet, earlier.zone, earlier.node.Line))
+			case earlier.zone == later.zone || longestMatch:
+			case earlier.ipNet.Contains(later.ipNet.IP) && maskSize(earlier.ipNet) <= maskSize(later.ipNet):
+				problems = append(problems, at(later.node, "SHADOWED NETWORK: %s, within %s (zone %s, line %d)",
+					later.ipNet, earlier.ipNet, earlier.zone, earlier.node.Line))
+			case later.ipNet.Contains(earlier.ipNet.IP):
+				warnings = append(warnings, at(later.node, "network %s overlaps %s (zone %s, line %d): the earlier zone answers its addresses",
+					later.ipNet, earlier.ipNet, earlier.zone, earlier.node.Line))
+			}
+		}
+	}
+	for j, later := range domains {
+		for _, earlier := range domains[:j] {
+			switch {
+			case earlier.name == later.name:
+				problems = append(problems, at(later.node, "DUPLICATE DOMAIN: %s (zone %s, line %d)",
+					later.name, earlier.zone, earlier.node.Line))
+			case earlier.zone == later.zone || longestMatch:
+			case dns.IsSubDomain(earlier.name, later.name):
+				problems = append(problems, at(later.node, "SHADOWED DOMAIN: %s, within %s (zone %s, line %d)",
+					later.name, earlier.name, earlier.zone, earlier.node.Line))
+			case dns.IsSubDomain(later.name, earlier.name):
+				warnings = append(warnings, at(later.node, "domain %s overlaps %s (zone %s, line %d): the earlier zone answers its names",
+					later.name, earlier.name, earlier.zone, earlier.node.Line))
+			}
+		}
+	}
+	return problems, warnings
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		longestMatch bool
+		problems     []string
+		warnings     []string
+	}{
+		{"valid", `
+- name: lan
+  networks: [10.0.0.0/8]
+  domains: [lan]
+  servers: [udp://10.0.0.1]
+- servers: [tls://9.9.9.9]
+`, false, nil, nil},
+		{"empty file", "", false, nil, nil},
+		{"not a list", "servers: [udp://9.9.9.9]\n", false, []string{"forward.yaml:1:1: EXPECTED A LIST OF ZONES"}, nil},
+		{"not a zone", "- udp://9.9.9.9\n", false, []string{"forward.yaml:1:3: EXPECTED A ZONE"}, nil},
+		{"unknown field", `
+- server: [udp://9.9.9.9]
+  servers: [udp://9.9.9.9]
+`, false, []string{"forward.yaml:2:3: UNKNOWN FIELD: server"}, nil},
+		{"type error", `
+- servers: udp://9.9.9.9
+`, false, []string{"forward.yaml:2:12: TYPE ERROR: servers expects a list"}, nil},
+		{"invalid values", `
+- networks:
+    - 10.0.0.0/33
+  domains:
+    - bad..domain
+  servers:
+    - udp://9.9.9.9?foo=1
+  proxy: ftp://127.0.0.1
+`, false, []string{
+			"forward.yaml:3:7: CIDR ERROR: 10.0.0.0/33",
+			"forward.yaml:5:7: DOMAIN ERROR: bad..domain",
+			"forward.yaml:7:7: UNKNOWN SERVER OPTION",
+			"forward.yaml:8:10: unsupported proxy scheme ftp",
+		}, nil},
+		{"IPv4-mapped network", `
+- networks: ["::ffff:10.0.0.0/104"]
+  servers: [udp://9.9.9.9]
+`, true, []string{"forward.yaml:2:14: IPV4-MAPPED NETWORK: ::ffff:10.0.0.0/104, matching IPv4 addresses as 10.0.0.0/8"}, nil},
+		{"IPv4-mapped network shadowed", `
+- networks: [10.0.0.0/8]
+  servers: [udp://9.9.9.9]
+- networks: ["::ffff:10.1.0.0/112"]
+  servers: [udp://1.1.1.1]
+`, false, []string{"IPV4-MAPPED NETWORK", "forward.yaml:4:14: SHADOWED NETWORK"}, nil},
+		{"zone without servers", `
+- domains: [lan]
+`, false, []string{"forward.yaml:2:3: ZONE WITHOUT SERVERS: lan"}, nil},
+		{"recursive zone", `
+- domains: [lan]
+  recursive: true
+`, false, nil, nil},
+		{"several default blocks", `
+- servers: [udp://9.9.9.9]
+- servers: [udp://1.1.1.1]
+`, false, []string{"forward.yaml:3:3: SEVERAL DEFAULT BLOCKS: first at line 2"}, nil},
+		{"duplicates", `
+- networks: [10.0.0.0/8]
+  domains: [lan]
+  servers: [udp://9.9.9.9]
+- networks: [10.0.0.0/8]
+  domains: [LAN.]
+  servers: [udp://1.1.1.1]
+`, true, []string{"forward.yaml:5:14: DUPLICATE NETWORK: 10.0.0.0/8", "forward.yaml:6:13: DUPLICATE DOMAIN: lan."}, nil},
+		{"shadowed", `
+- networks: [10.0.0.0/8]
+  domains: [lan]
+  servers: [udp://9.9.9.9]
+- networks: [10.1.0.0/16]
+  domains: [office.lan]
+  servers: [udp://1.1.1.1]
+`, false, []string{"forward.yaml:5:14: SHADOWED NETWORK: 10.1.0.0/16, within 10.0.0.0/8",
+			"forward.yaml:6:13: SHADOWED DOMAIN: office.lan., within lan."}, nil},
+		{"shadowed in longest match", `
+- networks: [10.0.0.0/8]
+  domains: [lan]
+  servers: [udp://9.9.9.9]
+- networks: [10.1.0.0/16]
+  domains: [office.lan]
+  servers: [udp://1.1.1.1]
+`, true, nil, nil},
+		{"overlapping", `
+- networks: [10.1.0.0/16]
+  domains: [office.lan]
+  servers: [udp://9.9.9.9]
+- networks: [10.0.0.0/8]
+  domains: [lan]
+  servers: [udp://1.1.1.1]
+`, false, nil, []string{"forward.yaml:5:14: network 10.0.0.0/8 overlaps 10.1.0.0/16",
+			"forward.yaml:6:13: domain lan. overlaps office.lan."}},
+		{"same zone", `
+- networks: [10.0.0.0/8, 10.1.0.0/16]
+  domains: [lan, office.lan]
+  servers: [udp://9.9.9.9]
+`, false, nil, nil},
+	}
+	for _, tt := range tests {
+		problems, warnings := validateConfig("forward.yaml", []byte(tt.config), tt.longestMatch)
+		check := func(kind string, got []error, want []string) {
+			if len(got) != len(want) {
+				t.Errorf("%s: %s %v, want %v", tt.name, kind, got, want)
+				return
+			}
+			for i, err := range got {
+				if !strings.Contains(err.Error(), want[i]) {
+					t.Errorf("%s: got %s, want %s", tt.name, err, want[i])
+				}
+			}
+		}
+		check("problems", problems, tt.problems)
+		check("warnings", warnings, tt.warnings)
+	}
+}